@@ -0,0 +1,236 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+// The 6551 ACIA (Asynchronous Communications Interface Adapter) is a
+// serial port with data, status, command and control registers. It is
+// connected to a host port (see openPort), so that the console, a
+// terminal program on a pseudo-terminal or files take the place of the
+// remote serial device.
+//
+// Characters take the time of a complete frame (start bit, data bits,
+// parity bit and stop bits) at the baud rate selected by the control
+// register, measured against the cycle clock. The external receiver
+// clock setting (baud rate select 0) is taken as 115200 baud. Host input
+// is paced to one character per frame and held while the receive data
+// register is full, as if the host honoured flow control, so overruns
+// never occur. Parity is not checked or generated.
+
+// ACIA register offsets
+const (
+	aciaData    = 0x0 // Transmit/receive data register
+	aciaStatus  = 0x1 // Status register (programmed reset when written)
+	aciaCommand = 0x2 // Command register
+	aciaControl = 0x3 // Control register
+)
+
+// ACIA status register flags
+const (
+	aciaParity  = 0x01 // Parity error
+	aciaFraming = 0x02 // Framing error
+	aciaOverrun = 0x04 // Overrun
+	aciaRdrf    = 0x08 // Receive data register full
+	aciaTdre    = 0x10 // Transmit data register empty
+	aciaIrq     = 0x80 // Interrupt has occurred
+)
+
+// ACIA command register fields
+const (
+	aciaDtr      = 0x01 // Data terminal ready (receiver enabled)
+	aciaIrd      = 0x02 // Receiver interrupt disabled
+	aciaTic      = 0x0C // Transmitter control
+	aciaTicIrq   = 0x04 // Transmitter on with interrupts enabled
+	aciaEcho     = 0x10 // Receiver echo mode
+	aciaParityOn = 0x20 // Parity enabled
+)
+
+// ACIA control register fields
+const (
+	aciaBaud  = 0x0F // Baud rate select
+	aciaWord  = 0x60 // Word length (8 bits less 0-3)
+	aciaStop2 = 0x80 // Two stop bits
+)
+
+// aciaBauds gives the baud rate for each baud rate select value.
+var aciaBauds = [16]float64{
+	115200, 50, 75, 109.92, 134.58, 150, 300, 600,
+	1200, 1800, 2400, 3600, 4800, 7200, 9600, 19200,
+}
+
+// aciaRegs is the state of an ACIA.
+// Fields must be exported for gob encoding.
+type aciaRegs struct {
+	Rx      uint8  // Receive data register
+	Tx      uint8  // Transmit data register
+	TxShift uint8  // Character being transmitted
+	TxBusy  bool   // Character being transmitted
+	TxEnd   uint64 // Cycle clock at end of transmission
+	RxNext  uint64 // Cycle clock of next possible character received
+	Status  uint8
+	Command uint8
+	Control uint8
+}
+
+// acia is a 6551 ACIA device.
+type acia struct {
+	id   string
+	port *hostPort
+	aciaRegs
+}
+
+// newAcia() creates an ACIA from a device specification.
+func newAcia(spec devSpec) (device, error) {
+	if err := spec.check("port", "in", "out"); err != nil {
+		return nil, err
+	}
+	port, err := openPort(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &acia{id: spec.name, port: port}, nil
+}
+
+func (a *acia) name() string { return a.id }
+
+func (a *acia) reset() {
+	a.aciaRegs = aciaRegs{Status: aciaTdre, RxNext: ck}
+}
+
+func (a *acia) read(off uint16) (data uint8) {
+	data = a.peek(off)
+	switch off {
+	case aciaData:
+		a.Status &^= aciaRdrf | aciaOverrun | aciaFraming | aciaParity
+	case aciaStatus:
+		a.Status &^= aciaIrq
+		setIrq(a, false)
+	}
+	return
+}
+
+func (a *acia) peek(off uint16) (data uint8) {
+	switch off {
+	case aciaData:
+		data = a.Rx
+	case aciaStatus:
+		data = a.Status
+	case aciaCommand:
+		data = a.Command
+	case aciaControl:
+		data = a.Control
+	}
+	return
+}
+
+func (a *acia) write(off uint16, data uint8) {
+	switch off {
+	case aciaData:
+		a.Tx = data
+		a.Status &^= aciaTdre
+	case aciaStatus:
+		a.Command &= 0xE0
+		a.Status &^= aciaOverrun
+	case aciaCommand:
+		a.Command = data
+		if a.txIrq() && a.Status&aciaTdre != 0 {
+			a.irq()
+		}
+	case aciaControl:
+		a.Control = data
+	}
+	if a.txOn() && a.Status&aciaTdre == 0 && !a.TxBusy {
+		a.startTx()
+	}
+}
+
+// tick() receives the next character of host input when the receiver
+// is enabled and ready.
+func (a *acia) tick(cycles uint64) {
+	if ck < a.RxNext || a.Status&aciaRdrf != 0 || a.Command&aciaDtr == 0 {
+		return
+	}
+	b, ok := a.port.recv()
+	if !ok {
+		return
+	}
+	a.Rx = b & a.mask()
+	a.Status |= aciaRdrf
+	a.RxNext = ck + a.frame()
+	if a.Command&aciaIrd == 0 {
+		a.irq()
+	}
+	if a.Command&aciaEcho != 0 {
+		a.port.send(a.Rx)
+	}
+}
+
+// txOn() checks whether the transmitter is on.
+func (a *acia) txOn() bool {
+	return a.Command&aciaTic != 0
+}
+
+// txIrq() checks whether transmitter interrupts are enabled.
+func (a *acia) txIrq() bool {
+	return a.Command&(aciaTic|aciaDtr) == aciaTicIrq|aciaDtr
+}
+
+// startTx() moves the transmit data register to the transmitter.
+func (a *acia) startTx() {
+	a.TxShift = a.Tx & a.mask()
+	a.TxBusy = true
+	a.TxEnd = ck + a.frame()
+	a.Status |= aciaTdre
+	if a.txIrq() {
+		a.irq()
+	}
+	schedule(a.TxEnd, a.endTx)
+}
+
+// endTx() sends a character to the host once transmitted and starts
+// the next character (if any).
+func (a *acia) endTx() {
+	a.port.send(a.TxShift)
+	a.TxBusy = false
+	if a.txOn() && a.Status&aciaTdre == 0 {
+		a.startTx()
+	}
+}
+
+// irq() signals an interrupt.
+func (a *acia) irq() {
+	a.Status |= aciaIrq
+	setIrq(a, true)
+}
+
+// mask() returns the mask for the data bits of a character.
+func (a *acia) mask() uint8 {
+	return 0xFF >> (a.Control & aciaWord >> 5)
+}
+
+// frame() returns the number of cycles taken by a character.
+func (a *acia) frame() uint64 {
+	bits := 10 - int(a.Control&aciaWord>>5)
+	if a.Command&aciaParityOn != 0 {
+		bits++
+	}
+	if a.Control&aciaStop2 != 0 {
+		bits++
+	}
+	return uint64(float64(cpuFreq)*float64(bits)/aciaBauds[a.Control&aciaBaud] + 0.5)
+}
+
+func (a *acia) state() []byte {
+	return encodeState(&a.aciaRegs)
+}
+
+func (a *acia) setState(state []byte) error {
+	a.aciaRegs = aciaRegs{}
+	if err := decodeState(state, &a.aciaRegs); err != nil {
+		return err
+	}
+	if a.TxBusy {
+		schedule(a.TxEnd, a.endTx)
+	}
+	setIrq(a, a.Status&aciaIrq != 0)
+	return nil
+}
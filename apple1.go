@@ -0,0 +1,157 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The Apple-1 has 4K or 8K of RAM at 0000, a 6821 PIA at D010-D013 for
+// the keyboard and display and the 256-byte Woz Monitor ROM at FF00,
+// which must be supplied by the user. The PIA interrupt outputs are not
+// connected.
+//
+//	D010  KBD    Keyboard data (bit 7 set)
+//	D011  KBDCR  Keyboard control (bit 7 set when a key is waiting)
+//	D012  DSP    Display data (bit 7 set while the display is busy)
+//	D013  DSPCR  Display control
+//
+// Keys typed at the console are sent to the keyboard port as they are
+// typed, with CA1 strobed for each key. Lower case letters are sent as
+// upper case, Enter as CR and backspace as the underscore used by the
+// Woz Monitor to rub out. A key is only sent once the previous one has
+// been read, so that input can also be pasted. Writing the display
+// port drives CB2 low. The display then reports itself busy on PB7 for
+// one character time (1/60 second, as the Apple-1 displays one character
+// per video frame, or no time at all with speed=max) before showing the
+// character and strobing CB1.
+
+// Apple-1 parameters
+const (
+	apple1Pia   = 0xD010 // PIA address
+	apple1Rom   = 0xFF00 // Woz Monitor address
+	apple1Frame = 60     // Characters displayed per second
+)
+
+// apple1Term is a host model of the Apple-1 keyboard and display.
+type apple1Term struct {
+	pia   *pia
+	port  *hostPort
+	delay uint64 // Cycles to display a character
+	busy  bool   // Character being displayed
+	char  uint8  // Character being displayed
+	wait  uint64 // Cycles until the character is displayed
+}
+
+// initApple1() sets up the Apple-1 memory map, ROM and PIA.
+func initApple1(spec devSpec) error {
+	if err := spec.check("rom", "ram", "speed"); err != nil {
+		return err
+	}
+	path, ok := spec.opts["rom"]
+	if !ok {
+		return fmt.Errorf("%s: rom= is required", spec.name)
+	}
+	if err := romFile(path, int64(romMax-apple1Rom)+1); err != nil {
+		return err
+	}
+	ramOpt, err := spec.opt("ram", "4k", "8k")
+	if err != nil {
+		return err
+	}
+	speed, err := spec.opt("speed", "apple1", "max")
+	if err != nil {
+		return err
+	}
+
+	ramTop, romBase = 0x0FFF, apple1Rom
+	if ramOpt == "8k" {
+		ramTop = 0x1FFF
+	}
+	binFiles = append(binFiles, binSpec{path: path, end: uint32(romMax), endSet: true})
+	devList = append(devList, devSpec{kind: "pia", name: "pia", at: apple1Pia, atSet: true,
+		opts: map[string]string{"irq": "off"}})
+	apple1Io = &apple1Term{}
+	if speed == "apple1" {
+		apple1Io.delay = cpuFreq / apple1Frame
+	}
+	return nil
+}
+
+// startApple1() connects the keyboard and display to the PIA and the
+// console.
+func startApple1() (err error) {
+	t := apple1Io
+	t.pia = findDev("pia").(*pia)
+	t.port = &hostPort{out: os.Stdout}
+	if t.port.in, err = conClaim("apple1"); err != nil {
+		return
+	}
+	conRawMode = true
+	models = append(models, t)
+	return watchPin("pia.cb2", t.strobe)
+}
+
+// reset() shows the display as ready.
+func (t *apple1Term) reset() {
+	t.busy = false
+	t.pia.setPin("pb", 0x7F)
+}
+
+// strobe() starts displaying the character written to the display port.
+func (t *apple1Term) strobe(level uint8) {
+	if level != 0 || t.busy {
+		return
+	}
+	t.busy, t.char, t.wait = true, t.pia.portB()&0x7F, t.delay
+	t.pia.setPin("pb", 0xFF)
+}
+
+// tick() completes the character being displayed and sends the next key
+// once the previous one has been read.
+func (t *apple1Term) tick(cycles uint64) {
+	if t.busy {
+		if cycles < t.wait {
+			t.wait -= cycles
+		} else {
+			t.show()
+		}
+	}
+	if t.pia.peek(piaCra)&piaC1Flag != 0 {
+		return
+	}
+	if key, ok := t.port.recv(); ok {
+		t.pia.setPin("pa", apple1Key(key))
+		t.pia.setPin("ca1", 0)
+		t.pia.setPin("ca1", 1)
+	}
+}
+
+// show() shows the character being displayed and signals that the
+// display is ready for the next.
+func (t *apple1Term) show() {
+	switch c := t.char; {
+	case c == '\r':
+		t.port.send('\n')
+	case c >= ' ' && c < 0x7F:
+		t.port.send(c)
+	}
+	t.busy = false
+	t.pia.setPin("pb", 0x7F)
+	t.pia.setPin("cb1", 0)
+	t.pia.setPin("cb1", 1)
+}
+
+// apple1Key() converts a console key to an Apple-1 keyboard code.
+func apple1Key(key uint8) uint8 {
+	switch {
+	case key == '\n':
+		key = '\r'
+	case key == 0x7F || key == '\b':
+		key = '_'
+	case key >= 'a' && key <= 'z':
+		key -= 'a' - 'A'
+	}
+	return key | 0x80
+}
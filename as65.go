@@ -0,0 +1,168 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The as65 -g option writes source-level debug information to a file
+// with the same name as the source and a .dbg extension (the same as
+// a cc65 dbg file, which is told apart by its header). The format is
+// not documented. As written by as65 1.42 it consists of:
+//
+// A header of "INFO", two characters giving the length of the rest of
+// the header (6 bits each, offset by '0'), a text description ending
+// with ^Z and some fixed bytes.
+//
+// The source files in the order they were first opened, each as a
+// length byte followed by the name as given on the command line or in
+// the include statement. File ids are numbered from 0 in this order.
+// The list ends with a zero byte.
+//
+// The symbols in name order, each as a length byte followed by the
+// name, a type byte and the value (32 bits if bit 7 of the type is set,
+// otherwise 16 bits). Bit 6 of the type is set for symbols defined by
+// equ, set or = rather than as a label. Macros are not included. The
+// list ends with a zero byte.
+//
+// The line table in address order, ending with a zero byte. There is a
+// record for each source line that generates code or data in the code
+// segment, giving the address of its first byte. A record starting with
+// a byte with bit 7 set gives the file id in bits 0-6 followed by the
+// 16-bit line number and 16-bit address. It is used whenever the file
+// changes or the increase in line number or address does not fit a
+// byte. Otherwise the record is two bytes giving the increase in line
+// number (1-127) and address (0-255) since the previous record.
+//
+// All 16 and 32-bit values are big-endian. Lines of macro expansions
+// are not recorded separately, so the record for the line that invokes
+// a macro covers all of its code. For example, the first records of
+// the line table for test.a65 are:
+//
+//	80 02 0F 10 00    test.a65 line 527 at $1000 (cld)
+//	20 01             line 559 at $1001
+//	02 02             line 561 at $1003
+//	01 01             line 562 at $1004
+
+// as65 debug information constants
+const (
+	as65DbgMagic = "INFO"
+	as65DbgLong  = 0x80 // Symbol value is 32-bit
+	as65DbgEqu   = 0x40 // Symbol is not a label
+	as65DbgFile  = 0x80 // Line record gives file id
+)
+
+// isAs65Dbg() checks for an as65 debug information file.
+func isAs65Dbg(buf []uint8) bool {
+	return bytes.HasPrefix(buf, []uint8(as65DbgMagic))
+}
+
+// loadAs65Dbg() loads as65 debug information from a dbg file image.
+// Labels are added to the source as labels and all other symbols
+// to the symbol table.
+func loadAs65Dbg(path string, buf []uint8) {
+	fmt.Fprintln(msgOut, "Found as65 dbg file:", path)
+	d, err := parseAs65Dbg(buf, path)
+	if err != nil {
+		loadFailed(fmt.Errorf("%s: %v", path, err))
+	}
+	labelCount := 0
+	for _, id := range d.symIds() {
+		sym := d.syms[id]
+		if sym.val > uint32(memMax) {
+			continue
+		}
+		addSym(sym.name, uint16(sym.val))
+		if sym.stype == "lab" {
+			sd := src[uint16(sym.val)]
+			sd.label = sym.name
+			src[uint16(sym.val)] = sd
+			labelCount++
+		}
+	}
+	dbg = d
+	fmt.Fprintln(msgOut, len(d.files), "source files,", len(d.lines), "source lines and", labelCount, "labels found\n")
+}
+
+// as65Reader reads big-endian fields from an as65 dbg file image.
+type as65Reader struct {
+	o65Reader
+}
+
+func (r *as65Reader) word() uint32 {
+	b := r.bytes(2)
+	return uint32(b[0])<<8 | uint32(b[1])
+}
+
+// parseAs65Dbg() converts an as65 dbg file image to debug information.
+// Each line is given a span reaching to the address of the next line,
+// so that a macro invocation covers the whole expansion. Where the next
+// line is further away than a line record can reach, the span covers
+// only the instruction at the address of the line.
+func parseAs65Dbg(buf []uint8, path string) (d *dbgInfo, err error) {
+	d = newDbgInfo(path)
+	r := &as65Reader{o65Reader{buf: buf}}
+
+	// header
+	r.bytes(len(as65DbgMagic))
+	size := r.bytes(2)
+	end := len(as65DbgMagic) + (int(size[0]-'0')<<6 | int(size[1]-'0'))
+	if r.err != nil || end > len(buf) || bytes.IndexByte(buf[:end], 0x1A) < 0 {
+		return nil, fmt.Errorf("invalid as65 dbg file header")
+	}
+	r.pos = end
+
+	// source files
+	for n := r.byte(); n != 0 && r.err == nil; n = r.byte() {
+		d.files[len(d.files)] = string(r.bytes(int(n)))
+	}
+
+	// symbols
+	for n := r.byte(); n != 0 && r.err == nil; n = r.byte() {
+		sym := dbgSym{name: string(r.bytes(int(n))), stype: "lab"}
+		stype := r.byte()
+		if stype&as65DbgEqu != 0 {
+			sym.stype = "equ"
+		}
+		if stype&as65DbgLong != 0 {
+			sym.val = r.word()<<16 | r.word()
+		} else {
+			sym.val = r.word()
+		}
+		d.syms[len(d.syms)] = sym
+	}
+
+	// line table
+	var addrs []uint32
+	var loc dbgLoc
+	addr := uint32(0)
+	for b := r.byte(); b != 0 && r.err == nil; b = r.byte() {
+		if b&as65DbgFile != 0 {
+			loc.file = int(b &^ as65DbgFile)
+			loc.line = int(r.word())
+			addr = r.word()
+		} else {
+			loc.line += int(b)
+			addr += uint32(r.byte())
+		}
+		if _, ok := d.files[loc.file]; !ok {
+			return nil, fmt.Errorf("line record for unknown file %d", loc.file)
+		}
+		d.lines = append(d.lines, dbgLine{loc.file, loc.line, dbgLineAsm, []int{len(addrs)}})
+		addrs = append(addrs, addr)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for i, start := range addrs {
+		size := uint32(opLen(readByte(uint16(start))))
+		if i+1 < len(addrs) && addrs[i+1] > start && addrs[i+1]-start <= 0xFF {
+			size = addrs[i+1] - start
+		}
+		d.spans[i] = dbgSpan{0, start, size}
+	}
+	d.mapLines()
+	return
+}
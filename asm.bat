@@ -1 +1 @@
-as65 -l -m -h0 test.a65
\ No newline at end of file
+as65 -l -m -h0 -g test.a65
\ No newline at end of file
@@ -9,28 +9,60 @@ import "fmt"
 // operation loop when in debug mode. If a break match is
 // found, the emulator is paused by reverting to step mode.
 // Current break functionality is very basic and must be
-// set programmatically
+// set programmatically, apart from user breakpoints
 func chkBreak() {
-	// As there is currently no keyboard interrupt,
-	// a regular break is performed every 100 virtual seconds
-	if ck > brkCK {
-		fmt.Println("\nBreak on time check\n")
+	// A regular break is performed every 100 virtual seconds.
+	// Machine profiles are left running, as they can be
+	// interrupted with Ctrl-C instead
+	if ck > brkCK && len(machArg) == 0 {
 		brkCK += 100000000
-		stepping = true
+		brkStop("Break on time check")
 	}
 	// It is also useful to break on a single line endless loop.
 	// This is the standard way for the error program to terminate
-	// both in the case of failure and success
-	if pc == brkPC {
-		fmt.Println("\nBreak on endless loop\n")
-		stepping = true
+	// both in the case of failure and success. Where devices may
+	// still interrupt, such a loop is waiting for an interrupt
+	if pc == brkPC && (len(devs) == 0 || tstI()) {
+		brkStop("Break on endless loop")
 	}
 	brkPC = pc
 	// The following line can be modified to break on a custom
 	// PC value (see assembler listing output). If not used,
 	// set to 0xFFFF
 	if pc == 0xFFFF {
-		fmt.Println("\nBreak on PC\n")
+		fmt.Fprintln(msgOut, "\nBreak on PC\n")
+		stepping = true
+	}
+	// User breakpoints are set with the b command
+	if brks[pc] && !stepping {
+		fmt.Fprintln(msgOut, "\nBreak at "+fmtPc()+" "+callLabel(pc)+"\n")
+		stepping = true
+	}
+}
+
+// brkStop() pauses the emulator by reverting to step mode. A program
+// started with -run may have nobody to continue it, so the run is
+// ended instead with a non-zero exit code.
+func brkStop(msg string) {
+	fmt.Fprintln(msgOut, "\n"+msg+"\n")
+	if runMode {
+		requestExit(1)
+	} else {
+		stepping = true
+	}
+}
+
+// trap() reports a failed run-time check at the current instruction.
+// Depending on the trap mode, the emulator may also be paused by
+// reverting to step mode.
+func trap(mode int, msg string) {
+	if mode == trapOff || mode == trapCount {
+		return
+	}
+	fmt.Fprintln(msgOut, "\n"+msg)
+	fmt.Fprintln(msgOut, "at "+fmtWord(opPc)+" "+callLabel(opPc)+"\n")
+	if mode == trapBreak {
+		debugging = true
 		stepping = true
 	}
 }
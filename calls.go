@@ -0,0 +1,124 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+)
+
+// The shadow call stack mirrors the subroutine and interrupt nesting
+// of the running program. Frames are recorded when return state is
+// pushed (JSR, BRK and interrupt entry) and removed when it is pulled
+// again (RTS and RTI). Frames are matched by stack pointer rather than
+// by simple nesting so that the shadow stack survives stack pointer
+// tricks such as TXS, discarded frames and return address juggling.
+
+// callEnter() records a new frame on the shadow call stack.
+// It must be called after the return state has been pushed
+// and the program counter set to the called routine. Any
+// existing frames at or below the new stack position have
+// been overwritten on the real stack and are discarded.
+func callEnter(kind int, site uint16, ret uint16) {
+	n := len(calls)
+	for n > 0 && calls[n-1].sp <= sp {
+		n--
+	}
+	calls = append(calls[:n], callFrame{kind, site, pc, ret, sp})
+}
+
+// callLeave() removes the frame matching a return instruction.
+// The top argument is the stack pointer before the return state
+// was pulled. The matching frame and any frames above it (which
+// can no longer be returned to) are discarded. A nil result means
+// that no recorded frame matched the return.
+func callLeave(top uint8) (f *callFrame) {
+	for i := len(calls) - 1; i >= 0; i-- {
+		if calls[i].sp == top {
+			frame := calls[i]
+			f = &frame
+			calls = calls[:i]
+			break
+		}
+	}
+	return
+}
+
+// callStacked() returns the return address currently held on the
+// real stack for a frame. This may differ from the recorded return
+// address if the stack has been manipulated manually.
+func callStacked(f callFrame) (ret uint16) {
+	base := saMin + uint16(f.sp)
+	switch f.kind {
+	case frameJsr:
+		ret = readWord(base+1) + 1
+	default:
+		ret = readWord(base + 2)
+	}
+	return
+}
+
+// callCheck() checks a frame against the real stack. An empty
+// string is returned if the frame is intact, otherwise a short
+// description of the manipulation is returned.
+func callCheck(f callFrame) (s string) {
+	switch {
+	case sp > f.sp:
+		s = "popped"
+	case callStacked(f) != f.ret:
+		s = "return address changed to " + fmtWord(callStacked(f))
+	}
+	return
+}
+
+// callLabel() formats an address using the function or procedure
+// covering it in the debug information or else the nearest preceding
+// label from the source listing (if any) within a short distance.
+func callLabel(addr uint16) (s string) {
+	if dbg != nil {
+		if s, ok := dbg.scopeLabel(addr); ok {
+			return s
+		}
+	}
+	for i := uint16(0); i < 0x100; i++ {
+		label := src[addr-i].label
+		if len(label) > 0 {
+			s = label
+			if i > 0 {
+				s += fmt.Sprintf("+%d", i)
+			}
+			break
+		}
+		if addr-i == 0 {
+			break
+		}
+	}
+	return
+}
+
+// fmtFrameKind() formats the kind of a call frame.
+func fmtFrameKind(kind int) (s string) {
+	switch kind {
+	case frameJsr:
+		s = "JSR"
+	case frameBrk:
+		s = "BRK"
+	case frameIrq:
+		s = "IRQ"
+	case frameNmi:
+		s = "NMI"
+	}
+	return
+}
+
+// fmtFrame() formats a call frame for the backtrace.
+func fmtFrame(i int, f callFrame) (s string) {
+	s = fmt.Sprintf("#%-2d %s %s %-16s -> %s %-16s ret %s",
+		i, fmtFrameKind(f.kind),
+		fmtWord(f.site), callLabel(f.site),
+		fmtWord(f.target), callLabel(f.target),
+		fmtWord(f.ret))
+	if chk := callCheck(f); len(chk) > 0 {
+		s += " ! " + chk
+	}
+	return
+}
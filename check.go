@@ -0,0 +1,168 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// All of the functions in this file implement optional run-time
+// checks. Each check reports (and optionally breaks on) events that
+// are legal for the CPU but almost always indicate a program bug.
+// Checks are enabled from the command line (see initArgs).
+
+// chkPush() checks for stack overflow before a byte is pushed.
+// The stack pointer wraps silently from $00 to $FF on real hardware.
+func chkPush() {
+	switch {
+	case sp == spMin:
+		trap(stackTrap, "Stack overflow (SP wrapped from 00 to FF)")
+	case sp < spLimLo:
+		trap(stackTrap, "Stack overflow (SP below limit "+fmtByte(spLimLo)+")")
+	}
+}
+
+// chkPop() checks for stack underflow before a byte is popped.
+// The stack pointer wraps silently from $FF to $00 on real hardware.
+// PLA and PLP are checked separately by chkPull().
+func chkPop() {
+	if op == 0x68 || op == 0x28 {
+		return
+	}
+	switch {
+	case sp == spMax:
+		trap(stackTrap, "Stack underflow (SP wrapped from FF to 00)")
+	case sp >= spLimHi:
+		trap(stackTrap, "Stack underflow (SP above limit "+fmtByte(spLimHi)+")")
+	}
+}
+
+// chkPull() checks for PLA or PLP from an empty stack. The stack is
+// empty at the top level when the stack pointer is at its upper limit.
+// Within a subroutine or interrupt handler, pulls may take the return
+// state, as in PLA PLA to drop a return address before an early exit.
+// The frame is removed from the shadow call stack once its return state
+// has been pulled completely. A return that follows a partial pull does
+// not match any frame and is reported by chkReturn().
+func chkPull() {
+	n := len(calls)
+	if n > 0 && int(sp)+1 == int(calls[n-1].sp)+frameSize(calls[n-1].kind) {
+		calls = calls[:n-1]
+	}
+	if stackTrap != trapOff && sp >= spLimHi {
+		trap(stackTrap, fmtBool(op == 0x68, "PLA", "PLP")+" from empty stack")
+	}
+}
+
+// frameSize() returns the number of bytes of return state pushed for
+// a kind of call frame.
+func frameSize(kind int) int {
+	if kind == frameJsr {
+		return 2
+	}
+	return 3
+}
+
+// chkReturn() checks the destination of an RTS or RTI instruction
+// against the frame (if any) removed from the shadow call stack.
+func chkReturn(f *callFrame) {
+	if stackTrap == trapOff {
+		return
+	}
+	mnem := fmtBool(op == 0x40, "RTI", "RTS")
+	dest := mnem + " to " + fmtWord(pc) + " " + callLabel(pc)
+	switch {
+	case f == nil:
+		trap(stackTrap, dest+" is not a recorded return point")
+	case f.ret != pc:
+		trap(stackTrap, dest+" but "+fmtFrameKind(f.kind)+" at "+
+			fmtWord(f.site)+" expects return to "+fmtWord(f.ret))
+	}
+}
+
+// chkUninit() reports a read of RAM that has not been written since
+// reset. Each byte is reported only once, after which it is treated
+// as written.
+func chkUninit(addr uint16) {
+	ramInit[addr-ramMin] = true
+	trap(uninitTrap, "Read of uninitialised RAM at "+fmtWord(addr)+" "+callLabel(addr))
+}
+
+// resetUninit() treats all RAM as not written since reset, apart
+// from loaded binary data.
+func resetUninit() {
+	for i := range ramInit {
+		ramInit[i] = loadOwner[int(ramMin)+i] != 0
+	}
+}
+
+// storeOp() returns true for opcodes that write memory without
+// reading it first (STA, STX and STY).
+func storeOp(op uint8) (b bool) {
+	switch op {
+	case 0x85, 0x95, 0x8D, 0x9D, 0x99, 0x81, 0x91, 0x86, 0x96, 0x8E, 0x84, 0x94, 0x8C:
+		b = true
+	}
+	return
+}
+
+// chkRomWrite() records (and optionally reports) a write to a
+// read-only or unmapped address. The write itself is discarded.
+func chkRomWrite(addr uint16, data uint8) {
+	key := uint32(opPc)<<16 | uint32(addr)
+	w := romWrites[key]
+	if w == nil {
+		w = &romWrite{pc: opPc, addr: addr}
+		romWrites[key] = w
+	}
+	w.data = data
+	w.count++
+	region := fmtBool(addr >= romBase && addr <= romMax, "ROM", "unmapped memory")
+	trap(romTrap, "Write of "+fmtByte(data)+" to "+region+" at "+
+		fmtWord(addr)+" "+callLabel(addr))
+}
+
+// reportRomWrites() prints a summary of all writes to read-only
+// or unmapped addresses, ordered by instruction and target address.
+func reportRomWrites() {
+	if romTrap == trapOff {
+		return
+	}
+	keys := make([]int, 0, len(romWrites))
+	for key := range romWrites {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	fmt.Fprintln(msgOut, "ROM Write Summary...\n")
+	for _, key := range keys {
+		w := romWrites[uint32(key)]
+		fmt.Fprintf(msgOut, "%s %-16s -> %s %-16s last %s count %d\n",
+			fmtWord(w.pc), callLabel(w.pc),
+			fmtWord(w.addr), callLabel(w.addr),
+			fmtByte(w.data), w.count)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(msgOut, "No ROM writes")
+	}
+	fmt.Fprintln(msgOut, "\nEnd of ROM Write Summary\n")
+}
+
+// markCode() marks the current instruction in the code map.
+func markCode() {
+	codeMap[opPc] |= codeOp
+	for i := 1; i < opLen(op); i++ {
+		codeMap[opPc+uint16(i)] |= codeOperand
+	}
+}
+
+// chkCodeWrite() records (and optionally reports) a write to an
+// address that has previously been executed as an opcode or operand.
+// This is the single point at which modified code is detected, so
+// any cached decoding of the instruction must be discarded here.
+func chkCodeWrite(addr uint16, data uint8) {
+	codeMap[addr] |= codeModified
+	kind := fmtBool(codeMap[addr]&codeOp != 0, "opcode", "operand")
+	trap(smcTrap, "Write of "+fmtByte(data)+" to "+kind+" at "+
+		fmtWord(addr)+" "+callLabel(addr))
+}
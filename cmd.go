@@ -4,27 +4,79 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
-func execCmd(cmd string) (pa postAction) {
-	cmd = strings.TrimSpace(cmd)
-	cmd = strings.ToLower(cmd)
+// readCmd() reads a line of user input from the console.
+// Once a device has claimed the console, input is buffered.
+// The end of console input is read as the quit command with a
+// non-zero exit code, as the program has not exited by itself.
+func readCmd() string {
+	conStop()
+	if conIn != nil {
+		line, ok := conLine()
+		if !ok {
+			return endOfInput()
+		}
+		return strings.TrimSpace(line)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return endOfInput()
+	}
+	return strings.TrimSpace(line)
+}
+
+// endOfInput() returns the quit command at the end of console input.
+func endOfInput() string {
+	fmt.Fprintln(msgOut, "\nEnd of input")
+	if exitCode == 0 {
+		exitCode = 1
+	}
+	return "q"
+}
+
+// execCmd() executes a command line. The first field selects the
+// command and any remaining fields are passed as arguments.
+func execCmd(line string) (pa postAction) {
+	args := strings.Fields(line)
+	cmd := ""
+	if len(args) > 0 {
+		cmd = strings.ToLower(args[0])
+		args = args[1:]
+	}
 	switch cmd {
 	case "":
 		pa = cmdStep()
 	case "g":
 		pa = cmdGo()
 	case "l":
-		pa = cmdList()
+		pa = cmdList(args)
 	case "m":
-		pa = cmdMem()
+		pa = cmdMem(args)
 	case "r":
 		pa = cmdReset()
 	case "s":
 		pa = cmdStack()
+	case "bt":
+		pa = cmdBacktrace()
 	case "z":
 		pa = cmdZero()
+	case "b":
+		pa = cmdBreak(args)
+	case "bc":
+		pa = cmdBreakClear(args)
+	case "bl":
+		pa = cmdBreakList()
+	case "io":
+		pa = cmdIo(args)
+	case "save":
+		pa = cmdSave(args)
+	case "restore":
+		pa = cmdRestore(args)
+	case "diff":
+		pa = cmdDiff(args)
 	case "q":
 		pa = cmdQuit()
 	default:
@@ -41,6 +93,7 @@ func cmdStep() (pa postAction) {
 func cmdGo() (pa postAction) {
 	stepping = false
 	fmt.Println("\nRunning (press Ctrl-C to interrupt)...")
+	conRun()
 	pa = postActionContinue
 	return
 }
@@ -51,17 +104,34 @@ func cmdQuit() (pa postAction) {
 	return
 }
 
-func cmdList() (pa postAction) {
+func cmdList(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) > 1 {
+		return cmdUsage("l [<file:line>|<function>]")
+	}
+	if len(args) == 1 {
+		if dbg == nil {
+			fmt.Println("\n*** NO DEBUG INFORMATION LOADED ***\n")
+			return
+		}
+		addr, ok := dbgLocate(args[0])
+		loc, found := dbg.locs[addr]
+		if !ok || !found {
+			fmt.Println("\n*** UNKNOWN LOCATION: " + args[0] + " ***\n")
+			return
+		}
+		dbgList(loc.file, loc.line)
+		return
+	}
 	fmt.Println("\nListing...\n")
 	addr := binStart
 	for {
-		cmd := ""
 		fmt.Print(fmtWord(addr) + " " + fmtSrc(addr) + " >")
-		fmt.Scanln(&cmd)
-		if cmd == "x" {
+		cmd := readCmd()
+		if cmd == "x" || cmd == "q" {
 			break
 		}
-		byteCount := src[addr].byteCount
+		byteCount := srcAt(addr).byteCount
 		// For non-source lines, increment address by one
 		if byteCount == 0 {
 			byteCount = 1
@@ -78,11 +148,163 @@ func cmdList() (pa postAction) {
 	return
 }
 
-func cmdMem() (pa postAction) {
+func cmdBreak(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) != 1 {
+		return cmdUsage("b <address>|<label>|<file:line>|<function>")
+	}
+	addr, ok := parseLoc(args[0])
+	if !ok {
+		fmt.Println("\n*** UNKNOWN LOCATION: " + args[0] + " ***\n")
+		return
+	}
+	brks[addr] = true
+	fmt.Println("\nBreakpoint set at " + fmtWord(addr) + " " + callLabel(addr) + "\n")
+	return
+}
+
+func cmdBreakClear(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) != 1 {
+		return cmdUsage("bc <address>|<label>|<file:line>|<function>|all")
+	}
+	if args[0] == "all" {
+		brks = make(map[uint16]bool)
+		fmt.Println("\nAll breakpoints cleared\n")
+		return
+	}
+	addr, ok := parseLoc(args[0])
+	if !ok || !brks[addr] {
+		fmt.Println("\n*** NO BREAKPOINT AT: " + args[0] + " ***\n")
+		return
+	}
+	delete(brks, addr)
+	fmt.Println("\nBreakpoint cleared at " + fmtWord(addr) + "\n")
+	return
+}
+
+func cmdBreakList() (pa postAction) {
+	fmt.Println("\nBreakpoints...\n")
+	addrs := make([]int, 0, len(brks))
+	for addr := range brks {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		line := fmtWord(uint16(addr)) + " " + callLabel(uint16(addr))
+		if dbg != nil {
+			if loc, ok := dbg.locs[uint16(addr)]; ok {
+				line += " " + dbg.fmtLoc(loc)
+			}
+		}
+		fmt.Println(line)
+	}
+	if len(addrs) == 0 {
+		fmt.Println("No breakpoints")
+	}
+	fmt.Println("\nEnd of Breakpoints\n")
+	pa = postActionHold
+	return
+}
+
+// cmdIo() lists the devices and their pins, shows or drives a device
+// pin, or watches a pin for changes driven by the device.
+func cmdIo(args []string) (pa postAction) {
+	pa = postActionHold
+	switch {
+	case len(args) == 0:
+		fmt.Println("\nDevices...\n")
+		for _, r := range devs {
+			line := r.dev.name() + " " + fmtWord(r.lo) + "-" + fmtWord(r.hi)
+			if dp, ok := r.dev.(devPins); ok {
+				for _, name := range dp.pins() {
+					line += " " + name + "=" + fmtByte(dp.pin(name))
+				}
+			}
+			fmt.Println(line)
+		}
+		if len(devs) == 0 {
+			fmt.Println("No devices")
+		}
+		fmt.Println("\nEnd of Devices\n")
+	case len(args) == 2 && args[0] == "watch":
+		name := args[1]
+		err := watchPin(name, func(level uint8) {
+			fmt.Println(name, "=", fmtByte(level), "at", fmtCk())
+		})
+		if err != nil {
+			fmt.Println("\n*** " + err.Error() + " ***\n")
+		}
+	case len(args) <= 2:
+		dp, pin, err := findPin(args[0])
+		if err != nil {
+			fmt.Println("\n*** " + err.Error() + " ***\n")
+			return
+		}
+		if len(args) == 2 {
+			level, err := parseHex(args[1], 8)
+			if err != nil {
+				return cmdUsage("io <dev.pin> <hh>")
+			}
+			dp.setPin(pin, uint8(level))
+		}
+		fmt.Println(args[0], "=", fmtByte(dp.pin(pin)))
+	default:
+		return cmdUsage("io [<dev.pin> [<hh>]] | io watch <dev.pin>")
+	}
+	return
+}
+
+// parseLoc() converts a command argument to an address. The argument
+// may be a source file line (file:line) or function name from the
+// debug information, a symbol or a hex address. Once symbols are
+// loaded, an unknown name that is also valid hex (such as a mistyped
+// label) is reported as taken for an address, unless written with $.
+func parseLoc(s string) (addr uint16, ok bool) {
+	if addr, ok = dbgLocate(s); ok {
+		return
+	}
+	if addr, ok = syms[s]; ok {
+		return
+	}
+	num, err := parseHex(s, 16)
+	if err != nil {
+		return
+	}
+	addr, ok = uint16(num), true
+	if (len(syms) > 0 || dbg != nil) && (s[0] < '0' || s[0] > '9') && s[0] != '$' {
+		fmt.Println("\nNo symbol " + s + ", taken as address $" + fmtWord(addr))
+	}
+	return
+}
+
+func cmdMem(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) > 2 {
+		return cmdUsage("m [<start> [<end>]]")
+	}
+	start, end := uint16(0x200), uint16(0x2ff)
+	if len(args) > 0 {
+		var ok bool
+		if start, ok = parseLoc(args[0]); !ok {
+			fmt.Println("\n*** UNKNOWN LOCATION: " + args[0] + " ***\n")
+			return
+		}
+		end = start + 0xff
+		if end < start {
+			end = memMax
+		}
+	}
+	if len(args) > 1 {
+		var ok bool
+		if end, ok = parseLoc(args[1]); !ok || end < start {
+			fmt.Println("\n*** INVALID END: " + args[1] + " ***\n")
+			return
+		}
+	}
 	fmt.Println("\nMemory Dump...")
-	dumpMem(0x200, 0x2ff)
+	dumpMem(start, end)
 	fmt.Println("End of Memory Dump\n")
-	pa = postActionHold
 	return
 }
 
@@ -102,6 +324,19 @@ func cmdStack() (pa postAction) {
 	return
 }
 
+func cmdBacktrace() (pa postAction) {
+	fmt.Println("\nBacktrace...\n")
+	for i := len(calls) - 1; i >= 0; i-- {
+		fmt.Println(fmtFrame(len(calls)-1-i, calls[i]))
+	}
+	if len(calls) == 0 {
+		fmt.Println("No active calls")
+	}
+	fmt.Println("\nEnd of Backtrace\n")
+	pa = postActionHold
+	return
+}
+
 func cmdZero() (pa postAction) {
 	fmt.Println("\nZero Page Dump...")
 	dumpMem(0x00, 0xFF)
@@ -110,6 +345,78 @@ func cmdZero() (pa postAction) {
 	return
 }
 
+func cmdSave(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) != 1 {
+		return cmdUsage("save <file>")
+	}
+	fmt.Println("\nSaving snapshot to " + args[0] + "...")
+	if err := saveSnap(args[0]); err != nil {
+		fmt.Println("\n*** " + err.Error() + " ***\n")
+		return
+	}
+	fmt.Println("Snapshot saved\n")
+	return
+}
+
+func cmdRestore(args []string) (pa postAction) {
+	pa = postActionHold
+	if len(args) != 1 {
+		return cmdUsage("restore <file>")
+	}
+	fmt.Println("\nRestoring snapshot from " + args[0] + "...")
+	if err := restoreSnap(args[0]); err != nil {
+		fmt.Println("\n*** " + err.Error() + " ***\n")
+		return
+	}
+	fmt.Println("Snapshot restored\n")
+	pa = postActionRefetch
+	return
+}
+
+func cmdDiff(args []string) (pa postAction) {
+	pa = postActionHold
+	var a, b *snapshot
+	var aName, bName string
+	var err error
+	files, asJson := diffArgs(args)
+	switch len(files) {
+	case 0:
+		if lastBrkSnap == nil {
+			fmt.Println("\n*** NO PREVIOUS BREAK ***\n")
+			return
+		}
+		a, aName = lastBrkSnap, "previous break"
+		b, bName = takeSnap(), "current state"
+	case 1:
+		a, err = loadSnap(files[0])
+		aName = files[0]
+		b, bName = takeSnap(), "current state"
+	case 2:
+		a, err = loadSnap(files[0])
+		aName = files[0]
+		if err == nil {
+			b, err = loadSnap(files[1])
+			bName = files[1]
+		}
+	default:
+		return cmdUsage("diff [-j] [<file> [<file>]]")
+	}
+	if err != nil {
+		fmt.Println("\n*** " + err.Error() + " ***\n")
+		return
+	}
+	fmt.Println()
+	printDiff(diffSnaps(a, b, aName, bName), asJson)
+	return
+}
+
+func cmdUsage(usage string) (pa postAction) {
+	fmt.Println("\n*** USAGE: " + usage + " ***\n")
+	pa = postActionHold
+	return
+}
+
 func cmdErr() (pa postAction) {
 	fmt.Println("\n*** UNKNOWN COMMAND ***\n")
 	pa = postActionHold
@@ -117,13 +424,25 @@ func cmdErr() (pa postAction) {
 }
 
 func dumpMem(start uint16, end uint16) {
-	for addr := start; addr <= end; addr++ {
+	for a := uint32(start); a <= uint32(end); a++ {
+		addr := uint16(a)
 		data := readByte(addr)
 		if addr&0x000F == 0 {
 			fmt.Println()
 			fmt.Print(fmtWord(addr), ": ")
 		}
 		fmt.Print(fmtByte(data) + " ")
+
+		// symbols in each line are shown at the end of the line
+		if addr&0x000F == 0x000F || addr == end {
+			first := addr & 0xFFF0
+			if first < start {
+				first = start
+			}
+			if names := fmtSyms(first, addr); len(names) > 0 {
+				fmt.Print(";" + names)
+			}
+		}
 	}
 	fmt.Println("\n")
 }
@@ -0,0 +1,124 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import "fmt"
+
+// The console device is a minimal character I/O device for test
+// programs, with no baud rate timing or interrupts. Writing the data
+// register sends a character to the host. Reading it takes the next
+// character of host input, or the no data value (default 00) if none
+// is waiting. The status register shows whether input is waiting,
+// which avoids the need for a no data value. Like the ACIA, it is
+// connected to a host port (the console by default). In line mode
+// (the default) console input is received a line at a time once the
+// line is entered. In raw mode each key is received as typed, without
+// echo, while the emulator is running.
+
+// Console register offsets
+const (
+	conData   = 0x0 // Data register
+	conStatus = 0x1 // Status register
+)
+
+// Console status register flags
+const (
+	conEof   = 0x20 // Host input has ended
+	conTxRdy = 0x40 // Ready to send (always set)
+	conRxRdy = 0x80 // Input waiting
+)
+
+// conRegs is the state of a console device.
+// Fields must be exported for gob encoding.
+type conRegs struct {
+	Rx    uint8 // Next input character
+	RxRdy bool  // Input waiting
+}
+
+// con is a console device.
+type con struct {
+	id     string
+	port   *hostPort
+	noData uint8
+	conRegs
+}
+
+// newCon() creates a console device from a device specification.
+func newCon(spec devSpec) (device, error) {
+	if err := spec.check("port", "in", "out", "mode", "nodata"); err != nil {
+		return nil, err
+	}
+	mode, err := spec.opt("mode", "line", "raw")
+	if err != nil {
+		return nil, err
+	}
+	noData := uint64(0)
+	if val, ok := spec.opts["nodata"]; ok {
+		if noData, err = parseHex(val, 8); err != nil {
+			return nil, fmt.Errorf("%s: invalid nodata=%s", spec.name, val)
+		}
+	}
+	port, err := openPort(spec)
+	if err != nil {
+		return nil, err
+	}
+	c := &con{id: spec.name, port: port, noData: uint8(noData)}
+	if mode == "raw" && conOwner == spec.name {
+		conRawMode = true
+	}
+	return c, nil
+}
+
+func (c *con) name() string { return c.id }
+
+func (c *con) reset() {
+	c.conRegs = conRegs{}
+}
+
+func (c *con) read(off uint16) (data uint8) {
+	data = c.peek(off)
+	if off == conData {
+		c.RxRdy = false
+	}
+	return
+}
+
+// peek() shows the next input character (if any) without taking it.
+func (c *con) peek(off uint16) (data uint8) {
+	if !c.RxRdy {
+		c.Rx, c.RxRdy = c.port.recv()
+	}
+	switch off {
+	case conData:
+		data = c.noData
+		if c.RxRdy {
+			data = c.Rx
+		}
+	case conStatus:
+		data = conTxRdy
+		if c.RxRdy {
+			data |= conRxRdy
+		}
+		if c.port.eof {
+			data |= conEof
+		}
+	}
+	return
+}
+
+func (c *con) write(off uint16, data uint8) {
+	if off == conData {
+		c.port.send(data)
+	}
+}
+
+func (c *con) tick(cycles uint64) {}
+
+func (c *con) state() []byte {
+	return encodeState(&c.conRegs)
+}
+
+func (c *con) setState(state []byte) error {
+	c.conRegs = conRegs{}
+	return decodeState(state, &c.conRegs)
+}
@@ -99,7 +99,8 @@ func chgC(val bool) {
 	}
 }
 
-// reset() clears CPU state and starts running from the reset vector.
+// reset() clears CPU state and starts running from the reset vector
+// (or from the start address of the binary file if requested).
 func reset() {
 	op = 0x00
 	ac = 0x00
@@ -108,7 +109,13 @@ func reset() {
 	sr = 0x00 | maskU | maskB
 	sp = spMax
 	pc = readWord(rstVec)
+	if entrySet {
+		pc = entryPc
+	}
 	ck = 0
+	calls = calls[:0]
+	resetUninit()
+	resetDevs()
 	time.Sleep(minSleep)
 	syncRefReal = time.Now()
 	syncRefCk = 0
@@ -116,14 +123,19 @@ func reset() {
 	syncCount = 0
 }
 
-// readByte() reads a byte from memory.
+// readByte() reads a byte from memory or a device register.
 // Unused memory areas read as all-ones to simulate pull-up
 // resistors on a typical data bus.
 func readByte(addr uint16) (data uint8) {
 	switch {
-	case addr >= romMin && addr <= romMax:
+	case devMap[addr] != 0:
+		data = devRead(devAt(addr), addr)
+	case addr >= romBase && addr <= romMax:
 		data = rom[addr-romMin]
-	case addr >= ramMin && addr <= ramMax:
+	case addr >= ramMin && addr <= ramTop:
+		if uninitTrap != trapOff && inOp && !ramInit[addr-ramMin] {
+			chkUninit(addr)
+		}
 		data = ram[addr-ramMin]
 	default:
 		data = 0xFF
@@ -131,17 +143,29 @@ func readByte(addr uint16) (data uint8) {
 	return
 }
 
-// writeByte() writes a byte to memory.
+// writeByte() writes a byte to memory or a device register.
 // Unused or ROM addresses are normally ignored, as would be 
 // the case with typical hardware. However, ROM data will be 
 // over-written when the global flash flag is set
 func writeByte(addr uint16, data uint8) {
 	switch {
-	case addr >= ramMin && addr <= ramMax:
+	case devMap[addr] != 0:
+		devWrite(devAt(addr), addr, data)
+	case addr >= ramMin && addr <= ramTop:
+		if smcTrap != trapOff && inOp && codeMap[addr]&(codeOp|codeOperand) != 0 {
+			chkCodeWrite(addr, data)
+		}
 		ram[addr-ramMin] = data
-	case addr >= romMin && addr <= romMax:
-		if flashing {
+		ramInit[addr-ramMin] = true
+	case addr >= romBase && addr <= romMax:
+		if flashing || romRam {
 			rom[addr-romMin] = data
+		} else if romTrap != trapOff && inOp {
+			chkRomWrite(addr, data)
+		}
+	default:
+		if romTrap != trapOff && inOp {
+			chkRomWrite(addr, data)
 		}
 	}
 }
@@ -172,33 +196,84 @@ func writeWord(addr uint16, data uint16) {
 // dummy byte is returned. If the non-writable addresses 
 // is readable, its read value is copied to the dummy
 // byte. If the target address is completely inaccessible,
-// the dummy byte is set to 0xFF.
+// the dummy byte is set to 0xFF. Writes through a dummy
+// reference are completed by endRef() once the current
+// instruction has finished. Device registers are always
+// accessed through a dummy byte.
 func refByte(addr uint16) (ref *uint8) {
 	switch {
-	case addr >= ramMin && addr <= ramMax:
+	case devMap[addr] != 0:
+		// Store instructions do not read the target
+		r := devAt(addr)
+		ref = new(uint8)
+		if storeOp(op) {
+			*ref = r.dev.peek(addr - r.lo)
+		} else {
+			*ref = devRead(r, addr)
+			refRmw, refOld = true, *ref
+		}
+		refAddr, refPend = addr, ref
+	case addr >= ramMin && addr <= ramTop:
+		if uninitTrap != trapOff && inOp && !ramInit[addr-ramMin] && !storeOp(op) {
+			chkUninit(addr)
+		}
 		ref = &ram[addr-ramMin]
-	case addr >= romMin && addr <= romMax:
-		if flashing {
+		ramInit[addr-ramMin] = true
+		if smcTrap != trapOff && inOp && codeMap[addr]&(codeOp|codeOperand) != 0 {
+			refAddr, refPend = addr, ref
+		}
+	case addr >= romBase && addr <= romMax:
+		if flashing || romRam {
 			ref = &rom[addr-romMin]
 		} else {
 			ref = new(uint8)
 			*ref = rom[addr-romMin]
+			refAddr, refPend = addr, ref
 		}
 	default:
 		ref = new(uint8)
 		*ref = 0xFF
+		refAddr, refPend = addr, ref
 	}
 	return
 }
 
+// endRef() completes a write through a reference returned
+// by refByte() that could not be checked in advance. Writes
+// through a dummy reference are discarded, apart from writes
+// to device registers. As on the NMOS 6502, read-modify-write
+// instructions write a device register twice, first with the
+// value read and then with the modified value.
+func endRef() {
+	switch {
+	case devMap[refAddr] != 0:
+		r := devAt(refAddr)
+		if refRmw {
+			devWrite(r, refAddr, refOld)
+		}
+		devWrite(r, refAddr, *refPend)
+	case refAddr >= ramMin && refAddr <= ramTop:
+		chkCodeWrite(refAddr, *refPend)
+	case romTrap != trapOff:
+		chkRomWrite(refAddr, *refPend)
+	}
+	refPend, refRmw = nil, false
+}
+
 // pushByte() saves byte to stack and decrements stack pointer
 func pushByte(data uint8) {
+	if stackTrap != trapOff {
+		chkPush()
+	}
 	writeByte(saMin+uint16(sp), data)
 	sp--
 }
 
 // popByte() increments stack pointer and reads byte from stack
 func popByte() uint8 {
+	if stackTrap != trapOff {
+		chkPop()
+	}
 	sp++
 	return readByte(saMin + uint16(sp))
 }
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"bufio"
+	"io"
 	"os"
 	"time"
 )
@@ -63,6 +65,165 @@ const (
 	syncsPerGc   uint64        = (syncFreq * gcInterval) / 1E9
 )
 
+// Addressing modes (see ops.go)
+const (
+	modeImp = iota // Implicit
+	modeAcc        // Accumulator
+	modeImm        // Immediate
+	modeZpg        // Zero Page
+	modeZpx        // Zero Page,X
+	modeZpy        // Zero Page,Y
+	modeRel        // Relative
+	modeAbs        // Absolute
+	modeAbx        // Absolute,X
+	modeAby        // Absolute,Y
+	modeInd        // Indirect
+	modeIdx        // Indexed Indirect using X
+	modeIdy        // Indirect Indexed using Y
+)
+
+// Code map flags
+const (
+	codeOp       uint8 = 0x01 // Executed as opcode
+	codeOperand  uint8 = 0x02 // Executed as operand
+	codeModified uint8 = 0x04 // Written after execution
+)
+
+// Trap modes for run-time checks
+const (
+	trapOff   = iota // Check disabled
+	trapWarn         // Report and continue
+	trapBreak        // Report and revert to step mode
+	trapCount        // Count silently for end-of-run summary
+)
+
+// RAM power-on fill patterns
+const (
+	fillOnes   = iota // All bytes $FF
+	fillZero          // All bytes $00
+	fillAlt           // Alternating $FF and $00
+	fillRandom        // Seeded random bytes
+)
+
+// Host port parameters
+const (
+	conBufSize = 256 // Size of host input buffers
+)
+
+// Call frame kinds
+const (
+	frameJsr = iota // Subroutine call (JSR)
+	frameBrk        // Software interrupt (BRK)
+	frameIrq        // Interrupt request
+	frameNmi        // Non-maskable interrupt
+)
+
+// callFrame is an entry on the shadow call stack.
+type callFrame struct {
+	kind   int
+	site   uint16 // Address of calling instruction (or interrupted PC)
+	target uint16 // Address of called routine or handler
+	ret    uint16 // Address at which execution resumes on return
+	sp     uint8  // Stack pointer after return state was pushed
+}
+
+// romWrite records writes by one instruction to one read-only address.
+type romWrite struct {
+	pc    uint16 // Address of writing instruction
+	addr  uint16 // Target address
+	data  uint8  // Last value written
+	count int    // Number of writes
+}
+
+// Snapshot file parameters
+const (
+	snapMagic   = "EM65SNAP" // File identifier
+	snapVersion = 3          // Current file format version
+)
+
+// binSpec specifies where to load a raw binary file (see -bin).
+// Exactly one of the first or last address of the data is given.
+type binSpec struct {
+	path   string
+	at     uint32 // First address of data
+	end    uint32 // Last address of data
+	off    uint32 // Offset of data in file
+	length uint32 // Length of data in file
+	atSet  bool
+	endSet bool
+	lenSet bool
+}
+
+type binSpecs []binSpec
+
+// o65Spec specifies where to relocate an o65 file (see -o65).
+// Segments other than text follow on unless their base is given.
+type o65Spec struct {
+	path    string
+	text    uint32 // Base address of text segment
+	data    uint32 // Base address of data segment
+	bss     uint32 // Base address of bss segment
+	zero    uint32 // Base address of zero page segment
+	dataSet bool
+	bssSet  bool
+	zeroSet bool
+}
+
+type o65Specs []o65Spec
+
+// loadSeg records the address range of data loaded from one file.
+type loadSeg struct {
+	path  string
+	lo    uint32 // Lowest address loaded
+	hi    uint32 // Highest address loaded
+	count int    // Number of bytes loaded
+}
+
+// devRange is a device registered at an address range.
+type devRange struct {
+	dev device
+	lo  uint16
+	hi  uint16
+}
+
+// devEvent is a device event scheduled at a cycle clock value.
+type devEvent struct {
+	at uint64
+	fn func()
+}
+
+// devSpec specifies a device to register at start-up (see -dev).
+// Options other than at= and name= are interpreted by the device.
+type devSpec struct {
+	kind  string
+	name  string
+	at    uint16 // First address of device registers
+	atSet bool
+	opts  map[string]string
+}
+
+type devSpecs []devSpec
+
+// machKind describes a machine profile that can be given with -machine.
+// init() sets up the memory map, ROM and devices from the options before
+// anything is loaded and start() attaches host models once the devices
+// are registered.
+type machKind struct {
+	init  func(spec devSpec) error // Sets up the machine
+	start func() error             // Attaches host models
+	usage string                   // Machine options
+}
+
+// devKind describes a type of device that can be given with -dev.
+type devKind struct {
+	size  uint32                             // Number of register addresses
+	make  func(spec devSpec) (device, error) // Creates a device
+	usage string                             // Device options
+}
+
+// pathList is a list of file paths given by a repeatable option.
+type pathList []string
+
 // srcData contains parsed original source for a given line/address.
 type srcData struct {
 	byteCount int
@@ -72,6 +233,12 @@ type srcData struct {
 	comment   string
 }
 
+// opDesc describes an opcode for disassembly.
+type opDesc struct {
+	mnem string // Mnemonic
+	mode int    // Addressing mode
+}
+
 type postAction int
 
 // mnems is a fast lookup table for 6502 mnemonics.
@@ -90,6 +257,26 @@ var mnems = map[string]bool{
 	"tya": true,
 }
 
+// lstParsers lists the supported LST file formats (see loadLst).
+var lstParsers = []lstParser{as65Lst{}, ca65Lst{}, tassLst{}, acmeLst{}, xaLst{}}
+
+// devKinds lists the devices that can be given with -dev.
+var devKinds = map[string]devKind{
+	"via":   {0x10, newVia, "via,at=hhhh[,name=via]"},
+	"pia":   {0x04, newPia, "pia,at=hhhh[,name=pia][,irq=on|off]"},
+	"con":   {0x02, newCon, "con,at=hhhh[,name=con][,port=stdio|pty|file|none][,in=file][,out=file][,mode=line|raw][,nodata=hh]"},
+	"riot":  {riotIoSize, newRiot, "riot,at=hhhh[,name=riot][,ram=hhhh]"},
+	"rriot": {rriotIoSize, newRriot, "rriot,at=hhhh[,name=rriot][,ram=hhhh][,rom=hhhh,image=file[,off=hhhh]]"},
+	"semi":  {0x10, newSemi, "semi,at=hhhh[,name=semi]"},
+	"acia":  {0x04, newAcia, "acia,at=hhhh[,name=acia][,port=stdio|pty|file|none][,in=file][,out=file]"},
+}
+
+// machKinds lists the machine profiles that can be given with -machine.
+var machKinds = map[string]machKind{
+	"apple1": {initApple1, startApple1, "apple1,rom=file[,ram=4k|8k][,speed=apple1|max]"},
+	"kim1":   {initKim1, startKim1, "kim1,rom=file[,mode=keypad|tty][,baud=n]"},
+}
+
 // opFuncs is a fast lookup table for implemented opcode functions.
 var opFuncs []func() = make([]func(), 256)
 
@@ -97,18 +284,100 @@ var opFuncs []func() = make([]func(), 256)
 var rom = make([]uint8, romSize) // ROM Memory
 var ram = make([]uint8, ramSize) // RAM Memory
 
+// Memory map within the RAM and ROM areas (see machine.go)
+var ramTop uint16 = ramMax  // Last RAM address
+var romBase uint16 = romMin // First ROM address
+
+// Machine profile (see machine.go)
+var machArg string       // Machine profile given on the command line
+var machine machKind     // Selected machine profile (if any)
+var apple1Io *apple1Term // Apple-1 keyboard and display
+var kim1Io *kim1Term     // KIM-1 keypad, display and teletype
+
+// Memory-mapped I/O devices (see dev.go)
+var devs []devRange                 // Registered devices
+var devMap = make([]uint8, memSize) // Device number (from 1) at each address
+var devIrqs uint64                  // IRQ line asserted by each device (bit per device)
+var devNmi bool                     // NMI edge pending
+var devEvents []devEvent            // Scheduled events in time order
+var devCk uint64                    // Cycle clock at last device tick
+var devList devSpecs                // Devices to register at start-up
+var models []hostModel              // Host models attached to device pins
+
+// sim65 programs (see sim65.go)
+var sim65Mode bool                // Running a sim65 program
+var sim65Sp uint8                 // Zero page address of C stack pointer
+var sim65Files map[int]*os.File   // Open host files by file descriptor
+
+// Host ports (see host.go)
+var conOwner string      // Device that has claimed the console (if any)
+var conIn chan uint8     // Console input once claimed
+var conRawMode bool      // Console in raw mode while running
+var conSaved *termState  // Console state saved while in raw mode
+var conRuns int          // Number of times the emulator has started running
+var ptySlaves []*os.File // Pseudo-terminal slaves held open
+
+// Host callbacks for device pins keyed by dev.pin (see watchPin)
+var pinHooks = make(map[string][]func(level uint8))
+
+// Memory shadow state
+var ramInit = make([]bool, ramSize)  // RAM written since reset
+var codeMap = make([]uint8, memSize) // Code map flags for each address
+var refAddr uint16                   // Target of pending reference
+var refPend *uint8                   // Pending reference (see refByte)
+var refRmw bool                      // Pending reference is read-modify-write
+var refOld uint8                     // Value read by read-modify-write
+
 // Program data
+var progPath string // Path of program given on command line
+var progName string // Name of loaded program
 var binStart uint16 // First address of binary data in ROM
+var binAssumed bool // Binary data address was assumed (raw binary)
+var useStart bool   // Start address from binary file overrides reset vector
+var entryPc uint16  // Start address overriding reset vector
+var entrySet bool   // Start address overriding reset vector is in use
+var entrySys bool   // Start address is SYS address of PRG BASIC stub
+var romRam bool     // ROM area is writable as RAM
+var progArgs []string // Arguments for the program (sim65 only)
+
+// Raw binary and o65 files to load at explicit addresses
+var binFiles binSpecs
+var o65Files o65Specs
+
+// Loaded data segments and segment number (from 1) of each address
+var loadSegs []loadSeg
+var loadOwner = make([]uint16, memSize)
+
+// Source code for each address
 var src = make(map[uint16]srcData)
+var dbg *dbgInfo // cc65 debug information (if any)
+
+// Symbol table (see sym.go)
+var syms = make(map[string]uint16)     // Symbol values by name
+var symNames = make(map[uint16]string) // First symbol name for each value
+var symFiles pathList                  // Symbol files to load at start-up
 
 // System variables
 var active bool           // Emulator is running or stepping through code
 var osSigs chan os.Signal // Operating System Signals
+var stdin *bufio.Reader   // Console input
+var snapPath string       // Snapshot to restore at start-up
+var dbgPath string        // cc65 debug information to load at start-up
+var diffMode bool         // Comparing snapshot files only
+var runMode bool          // Running from start-up without stepping
+var jsonOut bool          // Producing JSON output
 
 // Monitor variables
 var debugging bool // Currently in debug mode
 var stepping bool  // Currently stepping (in debug mode)
+var held bool      // Currently held at a break (in step mode)
 var flashing bool  // Currently allowing writes to ROM
+var inOp bool      // Currently executing an instruction
+var quitting bool  // Termination requested by the program
+var exitCode int   // Exit code requested by the program
+
+// Emulator messages (the standard error for sim65 programs)
+var msgOut io.Writer = os.Stdout
 
 // CPU State
 var ck uint64 // CPU Cycle Clock
@@ -120,12 +389,36 @@ var iy uint8  // Index Register Y
 var sp uint8  // Stack Pointer (Offset)
 var sr uint8  // Status Register
 
+// Instruction tracking
+var opPc uint16       // Address of current instruction
+var calls []callFrame // Shadow call stack (innermost frame last)
+
 //Sync Variables
 var syncRefReal time.Time
 var syncRefCk uint64
 var syncNextCk uint64
 var syncCount uint64
 
+// Check Variables
+var stackTrap int  // Stack check trap mode
+var spLimLo uint8  // Lowest stack pointer before overflow
+var spLimHi uint8  // Stack pointer when stack is empty
+var uninitTrap int // Uninitialised RAM read trap mode
+var ramFill int    // RAM power-on fill pattern
+var ramSeed int64  // RAM power-on random seed
+var romTrap int    // ROM write trap mode
+var smcTrap int    // Code write trap mode
+
+// ROM writes keyed by instruction and target address
+var romWrites = make(map[uint32]*romWrite)
+
+// Machine states at the two most recent breaks
+var thisBrkSnap *snapshot
+var lastBrkSnap *snapshot
+
 // Breakpoint Variables
 var brkCK uint64 // CPU Cycle Clock
 var brkPC uint16 // previous program counter 
+
+// User breakpoints (set with the b command)
+var brks = make(map[uint16]bool)
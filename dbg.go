@@ -0,0 +1,477 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The cc65 linker (ld65 --dbgfile) writes debug information as lines
+// of text, each consisting of a record type and a comma separated list
+// of key=value attributes, for example:
+//
+// file	id=0,name="hello.c",size=312,mtime=0x5F3A1C20,mod=0
+// line	id=4,file=0,line=7,type=1,span=2+3
+// seg	id=0,name="CODE",start=0x000200,size=0x0123,addrsize=absolute,type=ro
+// span	id=2,seg=0,start=16,size=3
+// sym	id=5,name="_main",addrsize=absolute,scope=0,def=9,val=0x210,seg=0,type=lab
+// csym	id=0,name="main",scope=1,type=0,sc=ext,sym=5
+// scope	id=1,name="_main",mod=0,type=scope,size=24,parent=0,sym=5,span=3
+//
+// Values are decimal or 0x-prefixed hex numbers, quoted strings or
+// lists of ids joined by "+". Lines of type 1 are C source lines, while
+// type 0 lines are assembly source and type 2 lines are macro expansions.
+// Where both apply to an address, the C source line is preferred.
+// Each C function and assembler .proc has a named scope covering its
+// code, which is used to name addresses in backtraces and reports.
+
+// Debug line types
+const (
+	dbgLineAsm   = 0
+	dbgLineC     = 1
+	dbgLineMacro = 2
+)
+
+// dbgInfo contains debug information loaded from a dbg file.
+type dbgInfo struct {
+	dir   string              // Directory of dbg file
+	files map[int]string      // Source file names by id
+	segs  map[int]uint32      // Segment start addresses by id
+	spans map[int]dbgSpan     // Address spans by id
+	lines []dbgLine           // Source lines
+	syms  map[int]dbgSym      // Assembler symbols by id
+	csyms []dbgCsym           // C symbols
+	scops []dbgScope          // Named scopes in id order
+	locs  map[uint16]dbgLoc   // Source location of each address
+	funcs map[uint16]int      // Innermost scope of each address (index into scops)
+	text  map[string][]string // Source file text (loaded on demand)
+	last  dbgLoc              // Last location shown when stepping
+}
+
+type dbgSpan struct {
+	seg   int
+	start uint32
+	size  uint32
+}
+
+type dbgLine struct {
+	file  int
+	line  int
+	ltype int
+	spans []int
+}
+
+type dbgSym struct {
+	name  string
+	val   uint32
+	stype string
+}
+
+type dbgCsym struct {
+	name string
+	sc   string
+	sym  int
+}
+
+type dbgScope struct {
+	name  string // Assembler name
+	cname string // C function name (if any)
+	size  int
+	sym   int // Symbol id of entry point (-1 if none)
+	spans []int
+}
+
+// dbgLoc is a source location. Line numbers start at 1.
+type dbgLoc struct {
+	file  int
+	line  int
+	ltype int
+}
+
+// loadDbg() loads cc65 debug information from a dbg file.
+// Assembler labels are added to the source as labels.
+// as65 dbg files are also accepted (see loadAs65Dbg).
+func loadDbg(path string) {
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if isAs65Dbg(buf) {
+		loadAs65Dbg(path, buf)
+		return
+	}
+
+	fmt.Fprintln(msgOut, "Found dbg file:", path)
+	d := newDbgInfo(path)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	lineCount := 0
+	for scanner.Scan() {
+		lineCount++
+		kind, attrs := dbgRecord(scanner.Text())
+		id := dbgNum(attrs["id"])
+		switch kind {
+		case "file":
+			d.files[id] = attrs["name"]
+		case "seg":
+			d.segs[id] = uint32(dbgNum(attrs["start"]))
+		case "span":
+			d.spans[id] = dbgSpan{dbgNum(attrs["seg"]),
+				uint32(dbgNum(attrs["start"])), uint32(dbgNum(attrs["size"]))}
+		case "line":
+			d.lines = append(d.lines, dbgLine{dbgNum(attrs["file"]), dbgNum(attrs["line"]),
+				dbgNum(attrs["type"]), dbgIds(attrs["span"])})
+		case "sym":
+			d.syms[id] = dbgSym{attrs["name"], uint32(dbgNum(attrs["val"])), attrs["type"]}
+		case "csym":
+			if sym, ok := attrs["sym"]; ok {
+				d.csyms = append(d.csyms, dbgCsym{attrs["name"], attrs["sc"], dbgNum(sym)})
+			}
+		case "scope":
+			sc := dbgScope{name: attrs["name"], size: dbgNum(attrs["size"]), sym: -1,
+				spans: dbgIds(attrs["span"])}
+			if sym, ok := attrs["sym"]; ok {
+				sc.sym = dbgNum(sym)
+			}
+			if len(sc.name) > 0 && len(sc.spans) > 0 {
+				d.scops = append(d.scops, sc)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	d.mapLines()
+	d.mapScopes()
+	labelCount := 0
+	for _, id := range d.symIds() {
+		sym := d.syms[id]
+		if sym.val > uint32(memMax) {
+			continue
+		}
+		addSym(sym.name, uint16(sym.val))
+		if sym.stype == "lab" {
+			sd := src[uint16(sym.val)]
+			sd.label = sym.name
+			src[uint16(sym.val)] = sd
+			labelCount++
+		}
+	}
+
+	dbg = d
+	fmt.Fprintln(msgOut, lineCount, "lines processed")
+	fmt.Fprintln(msgOut, len(d.files), "source files,", len(d.lines), "source lines and", labelCount, "labels found\n")
+}
+
+// newDbgInfo() returns empty debug information for a dbg file.
+func newDbgInfo(path string) *dbgInfo {
+	return &dbgInfo{
+		dir:   filepath.Dir(path),
+		files: make(map[int]string),
+		segs:  make(map[int]uint32),
+		spans: make(map[int]dbgSpan),
+		syms:  make(map[int]dbgSym),
+		locs:  make(map[uint16]dbgLoc),
+		funcs: make(map[uint16]int),
+		text:  make(map[string][]string),
+	}
+}
+
+// mapLines() maps each address to its preferred source line.
+func (d *dbgInfo) mapLines() {
+	for _, l := range d.lines {
+		loc := dbgLoc{l.file, l.line, l.ltype}
+		for _, addr := range d.lineAddrs(l) {
+			old, ok := d.locs[addr]
+			if !ok || old.ltype != dbgLineC || loc.ltype == dbgLineC {
+				d.locs[addr] = loc
+			}
+		}
+	}
+}
+
+// mapScopes() maps each address to the innermost (smallest) scope that
+// covers it and names the scopes of C functions.
+func (d *dbgInfo) mapScopes() {
+	for i := range d.scops {
+		sc := &d.scops[i]
+		for _, c := range d.csyms {
+			if c.sym == sc.sym {
+				sc.cname = c.name
+				break
+			}
+		}
+		for _, addr := range d.spanAddrs(sc.spans) {
+			old, ok := d.funcs[addr]
+			if !ok || sc.size < d.scops[old].size {
+				d.funcs[addr] = i
+			}
+		}
+	}
+}
+
+// symIds() returns the ids of all assembler symbols in order, so that
+// duplicate names (such as statics in different modules) are always
+// resolved in the same way.
+func (d *dbgInfo) symIds() (ids []int) {
+	for id := range d.syms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return
+}
+
+// dbgRecord() splits a dbg file line into its record type and attributes.
+// Quotes are removed from string values.
+func dbgRecord(line string) (kind string, attrs map[string]string) {
+	attrs = make(map[string]string)
+	fields := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+	kind = fields[0]
+	if len(fields) < 2 {
+		return
+	}
+	rest := fields[1]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		val := ""
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			val = rest[1 : end+1]
+			rest = rest[end+1:]
+			rest = strings.TrimPrefix(rest, "\"")
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			val = rest[:end]
+			rest = rest[end:]
+		}
+		attrs[key] = val
+		rest = strings.TrimPrefix(rest, ",")
+	}
+	return
+}
+
+// dbgNum() converts a decimal or 0x-prefixed hex dbg file value.
+// Invalid values convert to zero.
+func dbgNum(val string) int {
+	n, _ := strconv.ParseInt(val, 0, 64)
+	return int(n)
+}
+
+// dbgIds() converts a dbg file list of ids joined by "+".
+func dbgIds(val string) (ids []int) {
+	for _, id := range strings.Split(val, "+") {
+		if len(id) > 0 {
+			ids = append(ids, dbgNum(id))
+		}
+	}
+	return
+}
+
+// lineAddrs() returns all addresses covered by a source line.
+func (d *dbgInfo) lineAddrs(l dbgLine) []uint16 {
+	return d.spanAddrs(l.spans)
+}
+
+// spanAddrs() returns all addresses covered by a list of spans.
+func (d *dbgInfo) spanAddrs(spans []int) (addrs []uint16) {
+	for _, id := range spans {
+		span, ok := d.spans[id]
+		if !ok {
+			continue
+		}
+		start := d.segs[span.seg] + span.start
+		for i := uint32(0); i < span.size; i++ {
+			if start+i <= uint32(memMax) {
+				addrs = append(addrs, uint16(start+i))
+			}
+		}
+	}
+	return
+}
+
+// srcText() returns a line of source text (or an empty string if
+// the source file cannot be read). Source file names are relative
+// to the directory of the dbg file.
+func (d *dbgInfo) srcText(loc dbgLoc) string {
+	name := d.files[loc.file]
+	text, ok := d.text[name]
+	if !ok {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(d.dir, name)
+		}
+		if buf, err := os.ReadFile(path); err == nil {
+			text = strings.Split(strings.TrimSuffix(strings.ReplaceAll(string(buf), "\r\n", "\n"), "\n"), "\n")
+		}
+		d.text[name] = text
+	}
+	if loc.line < 1 || loc.line > len(text) {
+		return ""
+	}
+	return strings.TrimRight(text[loc.line-1], " \t")
+}
+
+// fmtLoc() formats a source location with its text.
+func (d *dbgInfo) fmtLoc(loc dbgLoc) string {
+	return fmt.Sprintf("%s:%d: %s", d.files[loc.file], loc.line, d.srcText(loc))
+}
+
+// dbgStep() shows the source line for the current instruction when
+// stepping, unless it is the same line as last shown.
+func dbgStep() {
+	if dbg == nil {
+		return
+	}
+	loc, ok := dbg.locs[pc]
+	if ok && loc != dbg.last {
+		fmt.Println(dbg.fmtLoc(loc))
+	}
+	dbg.last = loc
+}
+
+// findFile() returns the id of a source file by full or base name.
+func (d *dbgInfo) findFile(name string) (id int, ok bool) {
+	for i, f := range d.files {
+		if f == name || filepath.Base(f) == name {
+			return i, true
+		}
+	}
+	return
+}
+
+// lineAddr() returns the lowest address of the first line with code
+// at or after a given line in a source file.
+func (d *dbgInfo) lineAddr(file int, line int) (addr uint16, loc dbgLoc, ok bool) {
+	for _, l := range d.lines {
+		if l.file != file || l.line < line {
+			continue
+		}
+		addrs := d.lineAddrs(l)
+		if len(addrs) == 0 {
+			continue
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+		if !ok || l.line < loc.line || l.line == loc.line && addrs[0] < addr {
+			addr, loc, ok = addrs[0], dbgLoc{l.file, l.line, l.ltype}, true
+		}
+	}
+	return
+}
+
+// funcAddr() returns the address of a C function, assembler scope or
+// symbol. C functions are also found by their assembler name (with a
+// leading underscore). Where names are duplicated, the first scope or
+// symbol in id order is used.
+func (d *dbgInfo) funcAddr(name string) (addr uint16, ok bool) {
+	for _, sc := range d.scops {
+		if sc.cname == name || sc.name == name || sc.name == "_"+name {
+			if addr, ok = d.scopeAddr(sc); ok {
+				return
+			}
+		}
+	}
+	for _, c := range d.csyms {
+		if c.name == name {
+			if sym, found := d.syms[c.sym]; found {
+				return uint16(sym.val), true
+			}
+		}
+	}
+	for _, id := range d.symIds() {
+		if sym := d.syms[id]; sym.name == name || sym.name == "_"+name {
+			return uint16(sym.val), true
+		}
+	}
+	return
+}
+
+// scopeAddr() returns the entry point of a scope, which is the address
+// of its symbol or else the lowest address it covers.
+func (d *dbgInfo) scopeAddr(sc dbgScope) (addr uint16, ok bool) {
+	if sym, found := d.syms[sc.sym]; found && sym.val <= uint32(memMax) {
+		return uint16(sym.val), true
+	}
+	for _, a := range d.spanAddrs(sc.spans) {
+		if !ok || a < addr {
+			addr, ok = a, true
+		}
+	}
+	return
+}
+
+// scopeLabel() returns the name of the innermost scope covering an
+// address, with the offset from its entry point (if any).
+func (d *dbgInfo) scopeLabel(addr uint16) (s string, ok bool) {
+	i, ok := d.funcs[addr]
+	if !ok {
+		return
+	}
+	sc := d.scops[i]
+	s = sc.name
+	if len(sc.cname) > 0 {
+		s = sc.cname
+	}
+	if start, found := d.scopeAddr(sc); found && addr > start {
+		s += fmt.Sprintf("+%d", addr-start)
+	}
+	return
+}
+
+// dbgLocate() resolves a file:line location or function name.
+func dbgLocate(s string) (addr uint16, ok bool) {
+	if dbg == nil {
+		return
+	}
+	if i := strings.LastIndex(s, ":"); i > 0 {
+		line, err := strconv.Atoi(s[i+1:])
+		file, found := dbg.findFile(s[:i])
+		if err != nil || !found {
+			return
+		}
+		addr, _, ok = dbg.lineAddr(file, line)
+		return
+	}
+	return dbg.funcAddr(s)
+}
+
+// dbgList() lists source lines from a given location. Each line is
+// shown with the lowest address of its code (if any).
+func dbgList(file int, line int) {
+	fmt.Println("\nListing...\n")
+	for {
+		loc := dbgLoc{file, line, dbgLineAsm}
+		dbg.srcText(loc) // loads source text if necessary
+		if line > len(dbg.text[dbg.files[file]]) {
+			break
+		}
+		addr := "    "
+		if a, l, found := dbg.lineAddr(file, line); found && l.line == line {
+			addr = fmtWord(a)
+		}
+		fmt.Print(addr + " " + dbg.fmtLoc(loc) + " >")
+		if cmd := readCmd(); cmd == "x" || cmd == "q" {
+			break
+		}
+		line++
+	}
+	fmt.Println("\nEnd of Listing\n")
+}
@@ -0,0 +1,412 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Memory-mapped I/O devices are registered at address ranges, where
+// they take precedence over RAM and ROM. Register offsets passed to a
+// device are relative to the start of its range. Devices are ticked
+// before each instruction with the number of cycles elapsed since the
+// previous tick, may schedule events at future cycle clock values and
+// may drive the IRQ and NMI lines. IRQ is level-sensitive and remains
+// asserted while any device holds it. NMI is edge-triggered. Pending
+// interrupts are serviced between instructions.
+
+// device is a memory-mapped I/O device.
+// read() may have side effects (such as clearing status flags) and is
+// only used by executing instructions. peek() must not have any side
+// effects and is used to show device registers in the debugger.
+type device interface {
+	name() string
+	read(off uint16) uint8
+	peek(off uint16) uint8
+	write(off uint16, data uint8)
+	reset()
+	tick(cycles uint64)
+}
+
+// devSaver is implemented by devices whose state is saved in snapshots.
+// Scheduled events are not saved, so setState() must schedule again
+// any events that the restored state requires.
+type devSaver interface {
+	state() []byte
+	setState(state []byte) error
+}
+
+// devPins is implemented by devices with pins (ports and control lines)
+// that can be driven and watched by the host. Ports have a level for each
+// bit and control lines a level of 0 or 1. setPin() drives the pins that
+// are inputs; levels given for output pins are ignored.
+type devPins interface {
+	pins() []string
+	pin(name string) uint8
+	setPin(name string, level uint8)
+}
+
+// hostModel is a model of hardware outside the emulated devices, such as
+// a keyboard or display, which drives and watches device pins. Models are
+// ticked and reset along with the devices but their state is not saved in
+// snapshots.
+type hostModel interface {
+	reset()
+	tick(cycles uint64)
+}
+
+// addDev() registers a device at an address range.
+func addDev(dev device, lo uint16, hi uint16) error {
+	if hi < lo {
+		return fmt.Errorf("%s: invalid address range %s-%s", dev.name(), fmtWord(lo), fmtWord(hi))
+	}
+	for _, r := range devs {
+		if r.dev.name() == dev.name() {
+			return fmt.Errorf("%s: device already registered", dev.name())
+		}
+	}
+	for a := uint32(lo); a <= uint32(hi); a++ {
+		if n := devMap[a]; n != 0 {
+			return fmt.Errorf("%s: address %s already used by %s",
+				dev.name(), fmtWord(uint16(a)), devs[n-1].dev.name())
+		}
+	}
+	devs = append(devs, devRange{dev, lo, hi})
+	for a := uint32(lo); a <= uint32(hi); a++ {
+		devMap[a] = uint8(len(devs))
+	}
+	return nil
+}
+
+// initDevs() creates and registers the devices given on the command line.
+func initDevs(specs devSpecs) {
+	for _, spec := range specs {
+		kind := devKinds[spec.kind]
+		dev, err := kind.make(spec)
+		if err == nil {
+			err = addDev(dev, spec.at, uint16(uint32(spec.at)+kind.size-1))
+		}
+		if err != nil {
+			fmt.Fprintln(msgOut, "Cannot add device:", err)
+			fmt.Fprintln(msgOut, "Usage: -dev", kind.usage)
+			os.Exit(1)
+		}
+		r := devs[len(devs)-1]
+		fmt.Fprintln(msgOut, "Device", r.dev.name(), "at", fmtWord(r.lo)+"-"+fmtWord(r.hi))
+	}
+	if len(specs) > 0 {
+		fmt.Fprintln(msgOut)
+	}
+}
+
+// devKindNames() lists the kinds of device that can be given with -dev.
+func devKindNames() string {
+	var names []string
+	for name := range devKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// devAt() returns the device range at an address (or nil if none).
+func devAt(addr uint16) *devRange {
+	if n := devMap[addr]; n != 0 {
+		return &devs[n-1]
+	}
+	return nil
+}
+
+// devRead() reads a device register. Outside instructions
+// the register is only peeked.
+func devRead(r *devRange, addr uint16) uint8 {
+	if inOp {
+		return r.dev.read(addr - r.lo)
+	}
+	return r.dev.peek(addr - r.lo)
+}
+
+// devWrite() writes a device register.
+func devWrite(r *devRange, addr uint16, data uint8) {
+	r.dev.write(addr-r.lo, data)
+}
+
+// resetDevs() resets all devices along with the interrupt lines
+// and any scheduled events.
+func resetDevs() {
+	devIrqs = 0
+	devNmi = false
+	devEvents = devEvents[:0]
+	devCk = ck
+	for _, r := range devs {
+		r.dev.reset()
+	}
+	for _, m := range models {
+		m.reset()
+	}
+}
+
+// setIrq() asserts or releases the IRQ line on behalf of a device.
+func setIrq(dev device, on bool) {
+	for i, r := range devs {
+		if r.dev == dev {
+			if on {
+				devIrqs |= 1 << uint(i)
+			} else {
+				devIrqs &^= 1 << uint(i)
+			}
+		}
+	}
+}
+
+// raiseNmi() signals a falling edge on the NMI line.
+func raiseNmi() {
+	devNmi = true
+}
+
+// schedule() arranges for fn to be called once the cycle clock
+// reaches a given value. Events due at the same time are called
+// in the order they were scheduled.
+func schedule(at uint64, fn func()) {
+	i := sort.Search(len(devEvents), func(i int) bool { return devEvents[i].at > at })
+	devEvents = append(devEvents, devEvent{})
+	copy(devEvents[i+1:], devEvents[i:])
+	devEvents[i] = devEvent{at, fn}
+}
+
+// devCycle() ticks the devices, calls any events that are due
+// and services pending interrupts. It is called by the main
+// program loop before each instruction.
+func devCycle() {
+	if ck > devCk {
+		for _, r := range devs {
+			r.dev.tick(ck - devCk)
+		}
+		for _, m := range models {
+			m.tick(ck - devCk)
+		}
+		devCk = ck
+	}
+	for len(devEvents) > 0 && devEvents[0].at <= ck {
+		e := devEvents[0]
+		devEvents = devEvents[1:]
+		e.fn()
+	}
+	switch {
+	case devNmi:
+		devNmi = false
+		interrupt(nmiVec, frameNmi)
+	case devIrqs != 0 && !tstI():
+		interrupt(irqVec, frameIrq)
+	}
+}
+
+// interrupt() services a hardware interrupt. The status register
+// is pushed with the break flag clear. Checks made while pushing
+// the return state are reported at the interrupted address.
+func interrupt(vec uint16, kind int) {
+	opPc = pc
+	inOp = true
+	site := pc
+	pushWord(pc)
+	pushByte(sr &^ maskB)
+	setI()
+	pc = readWord(vec)
+	callEnter(kind, site, site)
+	ck += 7
+	inOp = false
+}
+
+// findDev() returns the device with the given name (or nil if none).
+func findDev(name string) device {
+	for _, r := range devs {
+		if r.dev.name() == name {
+			return r.dev
+		}
+	}
+	return nil
+}
+
+// findPin() returns the device and pin name given as dev.pin.
+func findPin(s string) (dp devPins, pin string, err error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return nil, "", fmt.Errorf("expected dev.pin: %s", s)
+	}
+	dp, ok := findDev(s[:i]).(devPins)
+	if !ok {
+		return nil, "", fmt.Errorf("no device with pins: %s", s[:i])
+	}
+	pin = strings.ToLower(s[i+1:])
+	for _, name := range dp.pins() {
+		if name == pin {
+			return
+		}
+	}
+	return nil, "", fmt.Errorf("no pin %s on %s", pin, s[:i])
+}
+
+// watchPin() registers a host callback for a device pin given as
+// dev.pin. The callback is called with the new level whenever the
+// device drives the pin to a different level.
+func watchPin(name string, fn func(level uint8)) error {
+	if _, _, err := findPin(name); err != nil {
+		return err
+	}
+	name = strings.ToLower(name)
+	pinHooks[name] = append(pinHooks[name], fn)
+	return nil
+}
+
+// pinOut() is called by a device when it drives a pin to a new level.
+func pinOut(dev device, pin string, level uint8) {
+	for _, fn := range pinHooks[strings.ToLower(dev.name())+"."+pin] {
+		fn(level)
+	}
+}
+
+// pinLevel() converts the level of a control line to a pin level.
+func pinLevel(high bool) uint8 {
+	if high {
+		return 1
+	}
+	return 0
+}
+
+// saveDevs() adds the state of each device to a snapshot.
+func saveDevs(ss *snapshot) {
+	for _, r := range devs {
+		if s, ok := r.dev.(devSaver); ok {
+			ss.Devs[r.dev.name()] = s.state()
+		}
+	}
+}
+
+// restoreDevs() restores the state of each device from a snapshot.
+// Devices missing from the snapshot are reset.
+func restoreDevs(ss *snapshot) error {
+	devIrqs = 0
+	devNmi = false
+	devEvents = devEvents[:0]
+	devCk = ck
+	for _, r := range devs {
+		s, ok := r.dev.(devSaver)
+		state, found := ss.Devs[r.dev.name()]
+		if !ok || !found {
+			r.dev.reset()
+			continue
+		}
+		if err := s.setState(state); err != nil {
+			return fmt.Errorf("%s: %v", r.dev.name(), err)
+		}
+	}
+	return nil
+}
+
+// encodeState() gob encodes device state for a snapshot.
+// Fields must be exported for gob encoding.
+func encodeState(state interface{}) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeState() decodes device state from a snapshot.
+func decodeState(buf []byte, state interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(state)
+}
+
+// String() formats a list of device specifications for the flag package.
+func (specs *devSpecs) String() string {
+	return fmt.Sprint(*specs)
+}
+
+// Set() parses a device specification for the flag package.
+// The format is kind,at=hhhh optionally followed by ,name=name
+// and any options of the device.
+func (specs *devSpecs) Set(val string) error {
+	fields := strings.Split(val, ",")
+	spec := devSpec{kind: strings.ToLower(fields[0]), opts: make(map[string]string)}
+	kind, ok := devKinds[spec.kind]
+	if !ok {
+		return fmt.Errorf("unknown device: %s", fields[0])
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=value: %s", field)
+		}
+		switch kv[0] {
+		case "at":
+			num, err := parseHex(kv[1], 16)
+			if err != nil {
+				return err
+			}
+			spec.at, spec.atSet = uint16(num), true
+		case "name":
+			spec.name = kv[1]
+		default:
+			spec.opts[kv[0]] = kv[1]
+		}
+	}
+	if !spec.atSet {
+		return fmt.Errorf("at= is required (%s)", kind.usage)
+	}
+	if uint32(spec.at)+kind.size-1 > uint32(memMax) {
+		return fmt.Errorf("address beyond %s", fmtWord(memMax))
+	}
+	if len(spec.name) == 0 {
+		// Further devices of the same kind are numbered from 2
+		n := 1
+		for _, s := range *specs {
+			if s.kind == spec.kind {
+				n++
+			}
+		}
+		spec.name = spec.kind
+		if n > 1 {
+			spec.name += fmt.Sprint(n)
+		}
+	}
+	*specs = append(*specs, spec)
+	return nil
+}
+
+// opt() returns a device option, checking it against a list of
+// allowed values (if any). The first allowed value is the default.
+func (spec devSpec) opt(key string, vals ...string) (string, error) {
+	val, ok := spec.opts[key]
+	switch {
+	case len(vals) == 0:
+		return val, nil
+	case !ok:
+		return vals[0], nil
+	}
+	for _, v := range vals {
+		if v == val {
+			return val, nil
+		}
+	}
+	return "", fmt.Errorf("%s: invalid %s=%s", spec.name, key, val)
+}
+
+// check() rejects any device options not in the given list.
+func (spec devSpec) check(keys ...string) error {
+next:
+	for key := range spec.opts {
+		for _, k := range keys {
+			if k == key {
+				continue next
+			}
+		}
+		return fmt.Errorf("%s: unknown option %s", spec.name, key)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// snapDiff lists the differences between two machine states.
+// All values are formatted as hex strings for JSON output.
+type snapDiff struct {
+	Old  string    `json:"old"`
+	New  string    `json:"new"`
+	Regs []regDiff `json:"registers"`
+	Mem  []memDiff `json:"memory"`
+}
+
+// regDiff is a changed register.
+type regDiff struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// memDiff is a range of consecutive changed memory bytes.
+type memDiff struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Label string `json:"label,omitempty"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// snapByte() reads a byte of RAM or ROM from a snapshot using
+// the memory map recorded in it. Device registers are not read,
+// so they appear as unmapped memory.
+func snapByte(ss *snapshot, addr uint16) (data uint8) {
+	switch {
+	case addr >= ss.RomBase && addr <= romMax:
+		data = ss.Rom[addr-romMin]
+	case addr >= ramMin && addr <= ss.RamTop:
+		data = ss.Ram[addr-ramMin]
+	default:
+		data = 0xFF
+	}
+	return
+}
+
+// diffSnaps() compares two machine states.
+func diffSnaps(a *snapshot, b *snapshot, aName string, bName string) (d snapDiff) {
+	d.Old, d.New = aName, bName
+	reg := func(name string, old string, new string) {
+		if old != new {
+			d.Regs = append(d.Regs, regDiff{name, old, new})
+		}
+	}
+	reg("CK", fmt.Sprintf("%011d", a.Ck), fmt.Sprintf("%011d", b.Ck))
+	reg("PC", fmtWord(a.Pc), fmtWord(b.Pc))
+	reg("AC", fmtByte(a.Ac), fmtByte(b.Ac))
+	reg("IX", fmtByte(a.Ix), fmtByte(b.Ix))
+	reg("IY", fmtByte(a.Iy), fmtByte(b.Iy))
+	reg("SP", fmtByte(a.Sp), fmtByte(b.Sp))
+	reg("SR", fmtByte(a.Sr), fmtByte(b.Sr))
+
+	var md *memDiff
+	for i := uint32(0); i < memSize; i++ {
+		addr := uint16(i)
+		old, new := snapByte(a, addr), snapByte(b, addr)
+		if old == new {
+			md = nil
+			continue
+		}
+		if md == nil {
+			d.Mem = append(d.Mem, memDiff{Start: fmtWord(addr), Label: callLabel(addr)})
+			md = &d.Mem[len(d.Mem)-1]
+		} else {
+			md.Old += " "
+			md.New += " "
+		}
+		md.End = fmtWord(addr)
+		md.Old += fmtByte(old)
+		md.New += fmtByte(new)
+	}
+	return
+}
+
+// printDiff() prints a machine state comparison in human-readable
+// or JSON form.
+func printDiff(d snapDiff, asJson bool) {
+	if asJson {
+		out, _ := json.MarshalIndent(d, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Println("Comparing", d.Old, "with", d.New, "\n")
+	for _, r := range d.Regs {
+		fmt.Printf("%-2s  %s -> %s\n", r.Name, r.Old, r.New)
+	}
+	if len(d.Regs) == 0 {
+		fmt.Println("No register changes")
+	}
+	fmt.Println()
+	for _, m := range d.Mem {
+		fmt.Printf("%s-%s %s\n", m.Start, m.End, m.Label)
+		fmt.Println("  old:", m.Old)
+		fmt.Println("  new:", m.New)
+	}
+	if len(d.Mem) == 0 {
+		fmt.Println("No memory changes")
+	}
+	fmt.Println()
+}
+
+// breakSnap() records the machine state at a break so that
+// successive breaks can be compared.
+func breakSnap() {
+	lastBrkSnap = thisBrkSnap
+	thisBrkSnap = takeSnap()
+}
+
+// diffMain() compares two snapshot files without running the
+// emulator. The source listing for the second snapshot is loaded
+// (if found) to provide labels. Progress messages are sent to
+// the standard error so that JSON output remains clean.
+func diffMain(aPath string, bPath string, asJson bool) {
+	a, err := loadSnap(aPath)
+	if err == nil {
+		var b *snapshot
+		b, err = loadSnap(bPath)
+		if err == nil {
+			ramTop, romBase = b.RamTop, b.RomBase
+			err = putSnap(b)
+		}
+		if err == nil {
+			if len(b.Name) > 0 {
+				loadLst(b.Name+".lst", os.Stderr)
+			}
+			printDiff(diffSnaps(a, b, aPath, bPath), asJson)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// diffArgs() splits diff command arguments into snapshot files
+// and an optional JSON output flag.
+func diffArgs(args []string) (files []string, asJson bool) {
+	for _, arg := range args {
+		if strings.ToLower(arg) == "-j" {
+			asJson = true
+		} else {
+			files = append(files, arg)
+		}
+	}
+	return
+}
@@ -0,0 +1,92 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+// opLen() returns the length in bytes of an instruction.
+// Unimplemented opcodes are treated as single bytes.
+func opLen(op uint8) (n int) {
+	switch opDescs[op].mode {
+	case modeImm, modeZpg, modeZpx, modeZpy, modeRel, modeIdx, modeIdy:
+		n = 2
+	case modeAbs, modeAbx, modeAby, modeInd:
+		n = 3
+	default:
+		n = 1
+	}
+	return
+}
+
+// disasm() disassembles the instruction at the given address.
+// Unimplemented opcodes are shown as data bytes.
+func disasm(addr uint16) (sd srcData) {
+	op := readByte(addr)
+	sd.byteCount = opLen(op)
+	if opFuncs[op] == nil {
+		sd.mnem = "db"
+		sd.operand = "$" + fmtByte(op)
+		return
+	}
+	sd.mnem = opDescs[op].mnem
+
+	// addresses are shown as symbols where possible
+	b := symOperand(uint16(readByte(addr+1)), "$"+fmtByte(readByte(addr+1)))
+	w := symOperand(readWord(addr+1), "$"+fmtWord(readWord(addr+1)))
+	switch opDescs[op].mode {
+	case modeAcc:
+		sd.operand = "a"
+	case modeImm:
+		sd.operand = "#$" + fmtByte(readByte(addr+1))
+	case modeZpg:
+		sd.operand = b
+	case modeZpx:
+		sd.operand = b + ",x"
+	case modeZpy:
+		sd.operand = b + ",y"
+	case modeRel:
+		target := addr + 2 + uint16(int8(readByte(addr+1)))
+		sd.operand = symOperand(target, "$"+fmtWord(target))
+	case modeAbs:
+		sd.operand = w
+	case modeAbx:
+		sd.operand = w + ",x"
+	case modeAby:
+		sd.operand = w + ",y"
+	case modeInd:
+		sd.operand = "(" + w + ")"
+	case modeIdx:
+		sd.operand = "(" + b + ",x)"
+	case modeIdy:
+		sd.operand = "(" + b + "),y"
+	}
+	return
+}
+
+// symOperand() returns the symbol for an operand address
+// or the given hex operand if there is no such symbol.
+func symOperand(addr uint16, hex string) string {
+	if name := symName(addr); len(name) > 0 {
+		return name
+	}
+	return hex
+}
+
+// srcAt() returns the source for an address. Where the LST file
+// provides no instruction for an address, the instruction is
+// disassembled instead if it is about to be executed, has been
+// executed before or if there is no source at all. Disassembled
+// instructions are labelled from the symbol table.
+func srcAt(addr uint16) (sd srcData) {
+	sd = src[addr]
+	if len(sd.mnem) > 0 {
+		return
+	}
+	if addr == pc || codeMap[addr]&codeOp != 0 || len(src) == 0 {
+		label := sd.label
+		if len(label) == 0 {
+			label = symName(addr)
+		}
+		sd = disasm(addr)
+		sd.label = label
+	}
+	return
+}
@@ -5,6 +5,60 @@ The EM65 emulator supports the 6502 CPU family.
 
 Operations
 
+The program to load is given on the command line (default "test"). The
+binary file format is selected by its extension as described below. With
+no recognised extension, a raw binary file with a .bin extension is
+assumed. The LST file has the same name with a .lst extension.
+
+Load HEX and S-records
+
+Loads Intel HEX (.hex or .ihx) or Motorola S-record (.s19, .s28, .s37,
+.srec or .mot) files, as written by the as65 -s2 and -s options. Each data
+record is placed at its stated address and every record checksum is
+verified. A bad record is reported with its file name and line number and
+the emulator exits. The start address record, if present, is reported and
+replaces the reset vector as the starting PC when the -start option is
+given.
+
+Load PRG
+
+Loads Commodore PRG (.prg) files into RAM at the load address given by the
+two-byte little-endian header. The -entry option sets the starting PC to a
+given hex address, or to the SYS address of a BASIC stub at the start of
+the program with -entry sys. A missing load address, a program that does
+not fit in RAM or a stub without a SYS address is reported and the
+emulator exits.
+
+Load sim65
+
+Loads programs built by cc65 for the sim6502 target, which are recognised
+by their sim65 header whatever their name. The program is loaded at the
+address given by the header and started at its start address. All memory
+is then writable as RAM and the sim65 paravirtualization hooks at
+FFF4-FFF9 (open, close, read, write, args and exit) are performed on the
+host, so that existing cc65 test programs run unchanged with the usual
+debugging facilities. Any arguments following the program are passed to
+it along with the program path, for example:
+
+	em65 -run tests/strtol arg1 arg2
+
+The exit code of the program becomes the exit code of the emulator. The
+standard output is left to the program and emulator messages are written
+to the standard error instead, so that the output of test programs can be
+compared as with sim65.
+
+Load o65
+
+Loads o65 relocatable object files with the repeatable -o65 option:
+
+	-o65 file,at=hhhh[,data=hhhh][,bss=hhhh][,zp=hh]
+
+The text segment is relocated to the given address and the data and bss
+segments follow it unless their own addresses are given. The zero page
+segment stays at its assembled address unless zp is given. Files with
+undefined references are rejected. Errors in a file are reported and the
+emulator exits. Exported globals are added as labels.
+
 Load BIN
 
 Loads raw binary data into memory.
@@ -16,6 +70,18 @@ assumption is reasonable because the exception vectors are located are
 located at the top-of-memory. To ensure that the binary file ends at $FFFF,
 specify all three vectors in the source file.
 
+Any number of additional raw binary files can be loaded at explicit
+addresses in RAM or ROM with the repeatable -bin option:
+
+	-bin file,at=hhhh     load with first byte at hhhh
+	-bin file,end=hhhh    load with last byte at hhhh
+
+Either form may be followed by ,off=hhhh and/or ,len=hhhh to load only
+part of the file. Data from different files may not overlap. Overlaps and
+offsets, lengths or end addresses that do not fit the file are reported
+and the emulator exits. A summary of what was loaded where is printed once
+all files are loaded.
+
 Load LST
 
 Loads source code from the assembler LST file output.
@@ -38,6 +104,229 @@ including those with pseudo-instructions are ignored. However a warning
 is issued if code errors are found. This is a useful verification step 
 to flag potential alignment problems in the binary file.
 
+Listings from ca65 (-l), 64tass (--list), ACME (-r) and xa (-P) are also
+supported. The format is detected automatically by choosing the one whose
+code bytes match the loaded binary data most often. Relocatable ca65
+addresses are taken as relative to the start of the loaded data.
+
+Load Symbols
+
+Symbols are collected from every label loaded, from the symbol table in
+the LST file when as65 is run with -t (which also lists equ constants,
+zero page variables and data labels) and from VICE label files (.lbl or
+.vs, such as those written by ld65 -Ln). A label file with the same name
+as the program is loaded if found and others can be given with the
+repeatable -sym option, which also accepts as65 symbol tables saved on
+their own. Values above $FFFF and macros are ignored. Symbols replace addresses in disassembled operands, are listed at
+the end of each line of a memory dump and may be used wherever a command
+takes an address, for example "m buffer" or "b loop".
+
+Load DBG
+
+Loads cc65 debug information written by the ld65 --dbgfile option. A DBG
+file with the same name as the program is loaded if found, or another file
+can be given with the -dbg option. Symbols are added as labels and, when
+stepping, the C (or assembler) source line is shown whenever execution
+moves to a new line. Source files are read relative to the DBG file.
+
+The scopes of C functions and assembler procedures (.proc) are used to
+name addresses in backtraces and reports, for example main+12.
+
+The source-level debug file written by the as65 -g option also has a .dbg
+extension and is recognised by its header. It maps each address to its
+line in the original source, including include files. Lines generated by
+a macro are shown as the line that invoked it, so exact source is shown
+even when the listing was made without -m. Its symbols are also loaded.
+
+Breakpoints are set with "b <loc>", cleared with "bc <loc>" (or "bc all")
+and listed with "bl". A location is a source line (file:line), a function
+name, a label or a hex address. "l <loc>" lists source lines from a given
+file:line or function. Breakpoints are saved in snapshots. A hex address
+that could be mistaken for a name is best written with a leading $.
+
+Snapshots
+
+The complete machine state (registers, cycle clock, RAM, ROM, shadow state,
+breakpoints, sync reference and device state) can be saved to a snapshot
+file with the "save <file>" command and restored with "restore <file>".
+A snapshot can also be restored at start-up with the -restore option.
+Snapshot files are versioned. Older versions are migrated when restored
+and versions that cannot be migrated are rejected with an error. The
+memory map is recorded, so that a snapshot is only restored with the same
+machine profile and can be compared on its own with -diff.
+
+The "diff" command lists changed registers and memory ranges, annotated
+with labels from the LST file. With no arguments it compares the state at
+the previous break with the current state. With one snapshot file it
+compares that snapshot with the current state and with two it compares
+the snapshots. The -j argument selects JSON output. Two snapshot files
+can also be compared without running the emulator:
+
+	em65 -diff [-json] old.snap new.snap
+
+Devices
+
+Memory-mapped I/O devices occupy address ranges that take precedence over
+RAM and ROM. Device registers are read and written by instructions as
+usual, while the debugger shows them without side effects. As on the NMOS
+6502, read-modify-write instructions write the value read before the
+modified value. Devices are advanced with the cycle clock before each
+instruction and may raise IRQ (level-sensitive, shared by all devices)
+or NMI (edge-triggered). Pending interrupts are serviced between
+instructions and appear on the shadow call stack. A single-line loop is
+not treated as endless while interrupts are enabled and devices are
+present. Device state is saved in snapshots.
+
+Devices are added with the repeatable -dev option:
+
+	-dev kind,at=hhhh[,name=name][,options]
+
+Further devices of the same kind are named with a number from 2 (via2,
+via3 and so on) unless named explicitly. The "io" command lists the
+devices and the levels of their pins. Device pins (ports and handshake
+lines) are shown with "io <dev.pin>", driven by the host with
+"io <dev.pin> <hh>" and watched for changes with "io watch <dev.pin>",
+so that pin activity can be scripted through the command prompt.
+
+The via device is a 6522 VIA occupying 16 addresses, with ports pa and
+pb, handshake lines ca1, ca2, cb1 and cb2, timers T1 and T2, the shift
+register and the interrupt flag and enable registers driving IRQ. Timers
+count every cycle. T1 supports one-shot and free-run modes with PB7
+output, T2 one-shot and PB6 pulse counting modes.
+
+The pia device is a 6821 PIA occupying 4 addresses, with ports pa and pb,
+each with a data direction register and a control register, and control
+lines ca1, ca2, cb1 and cb2. The control lines provide interrupt inputs,
+handshake and pulse outputs and manual outputs, and IRQA and IRQB are
+both wired to IRQ unless irq=off is given.
+
+The acia device is a 6551 ACIA occupying 4 addresses. Characters are
+transmitted and received at the baud rate and frame format selected by
+the control and command registers, with receive and transmit interrupts.
+The port= option connects it to the console (stdio, the default), to a
+new pseudo-terminal (pty) whose path is printed at start-up for screen
+or minicom to open, to files given by in= and out= (file) or to nothing
+(none). For example:
+
+	-dev acia,at=8800,port=file,in=input.txt,out=output.txt
+
+The con device is a minimal console for test programs occupying 2
+addresses: a data register (write to send a character, read to take the
+next input character or the nodata= value, default 00, if none) and a
+status register (bit 7 set when input is waiting, bit 6 always set as
+output is always ready, bit 5 set once input has ended). It takes the
+same port= options as the acia device. With mode=raw, console input is
+received as each key is typed without echo while the emulator is running,
+instead of a line at a time (mode=line, the default). For example:
+
+	-dev con,at=F000,mode=raw
+
+The semi device is a semihosting interface occupying 16 addresses, through
+which test programs can terminate the emulator with an exit code, print
+characters, strings and numbers, read host files into memory and capture
+the cycle clock (see semi.go for the registers and services). Together
+with the -run option, which starts running immediately instead of
+stepping, test programs can report their results in headless runs:
+
+	em65 -run -dev semi,at=7FF0 tests
+
+Runs started with -run end with exit code 1, instead of reverting to step
+mode, on an endless loop or time check. An illegal instruction also gives
+exit code 1, as does the end of console input at the command prompt, so
+that a failing headless run always terminates with an error. The regular
+time check break every 100 virtual seconds is not made with a machine
+profile, which is interrupted with Ctrl-C instead.
+
+The riot device is a 6532 RIOT occupying 32 addresses, with ports pa and
+pb, the interval timer (prescale of 1, 8, 64 or 1024 cycles) and the PA7
+edge detector driving IRQ. Its 128 bytes of RAM are placed separately
+with the ram= option, for example:
+
+	-dev riot,at=1700,ram=0080
+
+The rriot device is a 6530 RRIOT occupying 16 addresses, which is the
+same apart from having 64 bytes of RAM, no PA7 edge detector and 1K of
+ROM, placed with rom= and read from the file given by image= (from
+offset off= in the file). For example:
+
+	-dev rriot,at=1740,ram=17C0,rom=1C00,image=kim.bin,off=400
+
+When a device is connected to the console, console input typed while
+the emulator is running goes to the device, while input typed at the
+command prompt is taken as commands as usual. Only one device may be
+connected to the console.
+
+Machines
+
+The -machine option replaces the default memory map (RAM at 0000-7FFF
+and ROM at 8000-FFFF) with that of a particular machine, loads its ROM
+and adds its devices, with host models of its keyboard and display on
+the console. Memory outside the RAM, ROM and devices of the machine is
+unmapped. Programs can be loaded into RAM as usual.
+
+The apple1 machine is an Apple-1 with 4K (ram=4k, the default) or 8K
+(ram=8k) of RAM at 0000, the keyboard and display PIA at D010-D013 and
+the Woz Monitor ROM at FF00, which must be supplied with rom=. The
+display shows one character per video frame as on the Apple-1
+(speed=apple1, the default) or as fast as the program writes them
+(speed=max). Keys typed at the console while running go to the keyboard,
+with lower case letters sent as upper case and backspace sent as the
+underscore used by the Woz Monitor to rub out. For example:
+
+	em65 -run -machine apple1,rom=wozmon.bin,ram=8k
+
+The kim1 machine is a KIM-1 with 1K of RAM at 0000 and the two 6530
+RRIOTs (rriot003 at 1700 and rriot002 at 1740) holding the monitor ROM at
+1800-1FFF, which must be supplied as a 2K image with rom=. The top of the
+monitor ROM also appears at FFFA-FFFF for the vectors. The machine runs
+at 1 MHz in real time as usual, which the monitor relies on for its
+display, keypad and teletype timing. In keypad mode (mode=keypad, the
+default) the six-digit LED display is drawn in the terminal and keys
+typed at the console press the keypad keys: 0-9 and A-F for the hex
+keys, Ctrl-A for AD, Ctrl-D for DA, + or space for +, Ctrl-G for GO,
+Ctrl-P for PC, Ctrl-T for ST and Ctrl-R for RS. In teletype mode
+(mode=tty) the monitor's bit-banged serial routines talk to the console
+at the given baud rate (baud=, default 1200), with a RUBOUT sent after
+reset for the monitor to measure the baud rate. For example:
+
+	em65 -run -machine kim1,rom=kim.bin,mode=tty
+
+Run-time Checks
+
+Optional checks report events that are legal for the CPU but almost always
+indicate a program bug. Each check is enabled from the command line with a
+mode of off, warn (report and continue) or break (report and revert to step
+mode). Reports include the offending PC and its nearest label.
+
+The -stack check flags RTS or RTI to an address that is not a recorded
+return point on the shadow call stack, stack overflow or underflow past
+the limits given by -splo and -sphi (including silent wraparound through
+$00 and $FF) and PLA or PLP from an empty stack. Pulls that discard the
+whole return state of a subroutine or interrupt handler (such as PLA PLA
+before an early exit) are allowed.
+
+The -uninit check flags reads of RAM that has not been written since
+reset (including the reset command and machine reset keys, such as Ctrl-R
+on the KIM-1). Loaded binary data counts as written. Each byte is reported
+only once until the next reset. The RAM power-on contents are selected with
+-fill as ones ($FF, the default), zero, alt (alternating $00 and $FF) or
+random. The random pattern is reproducible by giving the seed printed at
+start-up with -seed.
+
+The -romw check flags writes to ROM or unmapped memory, which are
+otherwise silently discarded, showing the target address and value. In
+addition to the usual modes, count records such writes without reporting
+them individually. A summary of all such writes is printed when the
+emulator terminates.
+
+The -smc check tracks which addresses have been executed as opcode or
+operand bytes and flags later writes to them, whether deliberate self-
+modifying code or a stray store over code in RAM. Modified instructions
+are marked with an asterisk when stepping and listing.
+
+Instructions with no source in the LST file are disassembled when they
+are about to be executed or have been executed before.
+
 In debug mode, performance is sacrificed slightly in order to detect
 breakpoints. When stepping in debug mode, the CPU state is printed at
 each step followed by a user command prompt. The post action code returned
@@ -4,6 +4,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -20,6 +21,14 @@ func fmtBool(b bool, trueFmt string, falseFmt string) (f string) {
 func fmtByte(val uint8) string  { return fmt.Sprintf("%02X", val) }
 func fmtWord(val uint16) string { return fmt.Sprintf("%04X", val) }
 
+// parseHex() parses a hexadecimal number of the given bit size.
+// An optional $ or 0x prefix is accepted.
+func parseHex(s string, bits int) (uint64, error) {
+	s = strings.TrimPrefix(s, "$")
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	return strconv.ParseUint(s, 16, bits)
+}
+
 func fmtCk() string { return fmt.Sprintf("%011d", ck) }
 func fmtOp() string { return fmt.Sprintf("%02X", op) }
 func fmtPc() string { return fmt.Sprintf("%04X", pc) }
@@ -42,18 +51,29 @@ func fmtFlags() (s string) {
 	return
 }
 
+// fmtMark() marks an instruction with any byte that has been
+// written since it was executed as code (see chkCodeWrite).
+func fmtMark(addr uint16, byteCount int) string {
+	for i := 0; i < byteCount; i++ {
+		if codeMap[addr+uint16(i)]&codeModified != 0 {
+			return "*"
+		}
+	}
+	return " "
+}
+
 func fmtSrc(addr uint16) (s string) {
-	sd := src[addr]
+	sd := srcAt(addr)
 	fb := ""
 	for i := 0; i < sd.byteCount; i++ {
-		b := readByte(pc + uint16(i))
+		b := readByte(addr + uint16(i))
 		fb += fmtByte(b)
 	}
 	fb = fmt.Sprintf("%-6s", fb)[:6]
 	fl := fmt.Sprintf("%-12s", sd.label)[:12]
 	fm := fmt.Sprintf("%-3s", sd.mnem)
 	fo := fmt.Sprintf("%-14s", sd.operand)[:14]
-	return fb + " " + fl + " " + fm + " " + fo
+	return fmtMark(addr, sd.byteCount) + fb + " " + fl + " " + fm + " " + fo
 }
 
 func fmtState() string {
@@ -0,0 +1,155 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Devices exchange bytes with the host through host ports, which may be
+// connected to the console, a pseudo-terminal or files.
+//
+// The console is shared between the command prompt and at most one
+// device. Once a device claims the console, console input is read into
+// a buffer by a separate goroutine. Command lines are then taken from
+// the buffer while the emulator is stepping and device input while it
+// is running. The console may also be put into raw mode while running,
+// so that keys are received as typed without echo. Line editing is
+// restored at the command prompt.
+
+// hostPort connects a device to the host.
+type hostPort struct {
+	in  <-chan uint8 // Input from the host (nil if none)
+	out io.Writer    // Output to the host (nil if none)
+	eof bool         // Input from the host has ended
+}
+
+// conClaim() claims the console for a device and returns the channel
+// on which console input is received.
+func conClaim(name string) (<-chan uint8, error) {
+	if len(conOwner) > 0 {
+		return nil, fmt.Errorf("%s: console already used by %s", name, conOwner)
+	}
+	conOwner = name
+	conIn = make(chan uint8, conBufSize)
+	go func() {
+		for {
+			b, err := stdin.ReadByte()
+			if err != nil {
+				close(conIn)
+				return
+			}
+			conIn <- b
+		}
+	}()
+	return conIn, nil
+}
+
+// conLine() reads a line of console input from the buffer. It returns
+// false once console input has ended and no more is buffered.
+func conLine() (string, bool) {
+	var line []uint8
+	for {
+		b, ok := <-conIn
+		if !ok {
+			return string(line), len(line) > 0
+		}
+		if b == '\n' {
+			return string(line), true
+		}
+		line = append(line, b)
+	}
+}
+
+// conRun() puts the console into raw mode (if requested) when the
+// emulator starts running. Host models that redraw their output in place
+// use the count of runs to tell when other output may have intervened.
+func conRun() {
+	conRuns++
+	if conRawMode && conSaved == nil {
+		conSaved, _ = makeCbreak(os.Stdin.Fd())
+	}
+}
+
+// conStop() restores the console from raw mode.
+func conStop() {
+	if conSaved != nil {
+		restoreTerm(os.Stdin.Fd(), conSaved)
+		conSaved = nil
+	}
+}
+
+// readInto() copies input from the host into a channel.
+func readInto(r io.Reader) <-chan uint8 {
+	ch := make(chan uint8, conBufSize)
+	go func() {
+		buf := make([]uint8, conBufSize)
+		for {
+			n, err := r.Read(buf)
+			for _, b := range buf[:n] {
+				ch <- b
+			}
+			if err != nil {
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// openPort() opens the host port given by the port= option of a device:
+// stdio (the console, the default), pty (a new pseudo-terminal), file
+// (the files given by the in= and out= options) or none.
+func openPort(spec devSpec) (p *hostPort, err error) {
+	port, err := spec.opt("port", "stdio", "pty", "file", "none")
+	if err != nil {
+		return
+	}
+	p = &hostPort{}
+	switch port {
+	case "stdio":
+		p.in, err = conClaim(spec.name)
+		p.out = os.Stdout
+	case "pty":
+		var master *os.File
+		var path string
+		if master, path, err = openPty(); err == nil {
+			fmt.Fprintln(msgOut, spec.name+": connect a terminal program to", path)
+			p.in, p.out = readInto(master), master
+		}
+	case "file":
+		if path, ok := spec.opts["in"]; ok {
+			var file *os.File
+			if file, err = os.Open(path); err != nil {
+				return
+			}
+			p.in = readInto(file)
+		}
+		if path, ok := spec.opts["out"]; ok {
+			p.out, err = os.Create(path)
+		}
+	}
+	return
+}
+
+// recv() returns the next byte of host input (if any) without waiting.
+func (p *hostPort) recv() (b uint8, ok bool) {
+	select {
+	case b, ok = <-p.in:
+		if !ok {
+			p.in, p.eof = nil, true
+		}
+	default:
+	}
+	return
+}
+
+// send() sends a byte to the host.
+func (p *hostPort) send(b uint8) {
+	if p.out != nil {
+		p.out.Write([]uint8{b})
+	}
+}
@@ -3,8 +3,14 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
 // initAll() performs general program initialisation.
@@ -16,9 +22,122 @@ func initAll() {
 	initRam()
 }
 
+// initArgs() parses command line options.
+// It must be called before any other initialisation.
+func initArgs() {
+	var stack, splo, sphi, uninit, fill, romw, smc, entry string
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: em65 [options] [program [args]]")
+		fmt.Fprintln(os.Stderr, "       em65 -diff [-json] old.snap new.snap")
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&stack, "stack", "off", "stack check mode (off, warn, break)")
+	flag.StringVar(&splo, "splo", "00", "stack overflow limit (hex SP value)")
+	flag.StringVar(&sphi, "sphi", "FF", "stack empty limit (hex SP value)")
+	flag.StringVar(&uninit, "uninit", "off", "uninitialised RAM read check mode (off, warn, break)")
+	flag.StringVar(&fill, "fill", "ones", "RAM power-on pattern (ones, zero, alt, random)")
+	flag.Int64Var(&ramSeed, "seed", 0, "seed for random RAM power-on pattern (0 for time-based)")
+	flag.StringVar(&romw, "romw", "off", "ROM and unmapped write check mode (off, warn, count, break)")
+	flag.StringVar(&smc, "smc", "off", "code write check mode (off, warn, break)")
+	flag.StringVar(&snapPath, "restore", "", "snapshot file to restore at start-up")
+	flag.Var(&binFiles, "bin", "raw binary `file,at=hhhh|end=hhhh[,off=hhhh][,len=hhhh]` to load (repeatable)")
+	flag.Var(&o65Files, "o65", "o65 `file,at=hhhh[,data=hhhh][,bss=hhhh][,zp=hh]` to relocate and load (repeatable)")
+	flag.Var(&devList, "dev", "I/O device `kind,at=hhhh[,name=name][,options]` to add (repeatable, kinds: "+devKindNames()+")")
+	flag.StringVar(&machArg, "machine", "", "machine profile `kind[,options]` in place of the default memory map (kinds: "+machKindNames()+")")
+	flag.Var(&symFiles, "sym", "VICE label or symbol table `file` to load (repeatable)")
+	flag.StringVar(&dbgPath, "dbg", "", "cc65 or as65 debug information `file` (default program.dbg if found)")
+	flag.BoolVar(&useStart, "start", false, "start at address from HEX or S-record file instead of reset vector")
+	flag.StringVar(&entry, "entry", "", "start `address` (hex) instead of reset vector, or sys for PRG BASIC stub")
+	flag.BoolVar(&runMode, "run", false, "start running immediately instead of stepping")
+	flag.BoolVar(&diffMode, "diff", false, "compare two snapshot files given as arguments and exit")
+	flag.BoolVar(&jsonOut, "json", false, "produce JSON output for -diff")
+	flag.Parse()
+	initMachine()
+	switch entry {
+	case "":
+	case "sys":
+		entrySys = true
+	default:
+		entryPc, entrySet = uint16(argHex("entry", entry, 16)), true
+	}
+	switch {
+	case diffMode:
+		if flag.NArg() != 2 {
+			argErr("diff", strings.Join(flag.Args(), " "))
+		}
+	case flag.NArg() >= 1:
+		progPath = flag.Arg(0)
+		progArgs = flag.Args()[1:]
+	case len(binFiles) == 0 && len(o65Files) == 0:
+		progPath = "test"
+	}
+	stackTrap = argTrap("stack", stack, false)
+	spLimLo = uint8(argHex("splo", splo, 8))
+	spLimHi = uint8(argHex("sphi", sphi, 8))
+	uninitTrap = argTrap("uninit", uninit, false)
+	ramFill = argFill("fill", fill)
+	romTrap = argTrap("romw", romw, true)
+	smcTrap = argTrap("smc", smc, false)
+}
+
+// argTrap() converts a command line option to a trap mode.
+// The count mode is only accepted for checks that print a summary.
+func argTrap(name string, val string, count bool) (mode int) {
+	switch val {
+	case "off":
+		mode = trapOff
+	case "warn":
+		mode = trapWarn
+	case "break":
+		mode = trapBreak
+	case "count":
+		if !count {
+			argErr(name, val)
+		}
+		mode = trapCount
+	default:
+		argErr(name, val)
+	}
+	return
+}
+
+// argFill() converts a command line option to a RAM fill pattern.
+func argFill(name string, val string) (pattern int) {
+	switch val {
+	case "ones":
+		pattern = fillOnes
+	case "zero":
+		pattern = fillZero
+	case "alt":
+		pattern = fillAlt
+	case "random":
+		pattern = fillRandom
+	default:
+		argErr(name, val)
+	}
+	return
+}
+
+// argHex() converts a command line option to a hex number.
+func argHex(name string, val string, bits int) (num uint64) {
+	num, err := parseHex(val, bits)
+	if err != nil {
+		argErr(name, val)
+	}
+	return
+}
+
+// argErr() reports an invalid command line option and exits.
+func argErr(name string, val string) {
+	fmt.Fprintf(os.Stderr, "invalid value %q for -%s\n", val, name)
+	flag.Usage()
+	os.Exit(2)
+}
+
 // initSys() performs system initialisation
 func initSys() {
 	active = false
+	stdin = bufio.NewReader(os.Stdin)
 	osSigs = make(chan os.Signal, 1)
 	signal.Notify(osSigs, os.Interrupt, os.Kill)
 	go osSigHandler()
@@ -27,7 +146,7 @@ func initSys() {
 // initDebug() initialises debug parameters.
 func initDebug() {
 	debugging = true
-	stepping = true
+	stepping = !runMode
 	brkCK = 100000000
 	brkPC = 0xFFFF
 }
@@ -221,6 +340,195 @@ func initOps() {
 	opFuncs[0x98] = tyaImp
 }
 
+// opDescs gives the mnemonic and addressing mode of each opcode
+// implemented by initOps() for disassembly. Unused or unimplemented
+// opcodes have no entry.
+var opDescs = [256]opDesc{
+	0x69: {"adc", modeImm},
+	0x65: {"adc", modeZpg},
+	0x75: {"adc", modeZpx},
+	0x6D: {"adc", modeAbs},
+	0x7D: {"adc", modeAbx},
+	0x79: {"adc", modeAby},
+	0x61: {"adc", modeIdx},
+	0x71: {"adc", modeIdy},
+
+	0x29: {"and", modeImm},
+	0x25: {"and", modeZpg},
+	0x35: {"and", modeZpx},
+	0x2D: {"and", modeAbs},
+	0x3D: {"and", modeAbx},
+	0x39: {"and", modeAby},
+	0x21: {"and", modeIdx},
+	0x31: {"and", modeIdy},
+
+	0x0A: {"asl", modeAcc},
+	0x06: {"asl", modeZpg},
+	0x16: {"asl", modeZpx},
+	0x0E: {"asl", modeAbs},
+	0x1E: {"asl", modeAbx},
+
+	0x90: {"bcc", modeRel},
+	0xB0: {"bcs", modeRel},
+	0xF0: {"beq", modeRel},
+	0x30: {"bmi", modeRel},
+	0xD0: {"bne", modeRel},
+	0x10: {"bpl", modeRel},
+	0x50: {"bvc", modeRel},
+	0x70: {"bvs", modeRel},
+
+	0x24: {"bit", modeZpg},
+	0x2C: {"bit", modeAbs},
+
+	0x00: {"brk", modeImp},
+
+	0x18: {"clc", modeImp},
+	0xD8: {"cld", modeImp},
+	0x58: {"cli", modeImp},
+	0xB8: {"clv", modeImp},
+
+	0xC9: {"cmp", modeImm},
+	0xC5: {"cmp", modeZpg},
+	0xD5: {"cmp", modeZpx},
+	0xCD: {"cmp", modeAbs},
+	0xDD: {"cmp", modeAbx},
+	0xD9: {"cmp", modeAby},
+	0xC1: {"cmp", modeIdx},
+	0xD1: {"cmp", modeIdy},
+
+	0xE0: {"cpx", modeImm},
+	0xE4: {"cpx", modeZpg},
+	0xEC: {"cpx", modeAbs},
+
+	0xC0: {"cpy", modeImm},
+	0xC4: {"cpy", modeZpg},
+	0xCC: {"cpy", modeAbs},
+
+	0xC6: {"dec", modeZpg},
+	0xD6: {"dec", modeZpx},
+	0xCE: {"dec", modeAbs},
+	0xDE: {"dec", modeAbx},
+
+	0xCA: {"dex", modeImp},
+	0x88: {"dey", modeImp},
+
+	0x49: {"eor", modeImm},
+	0x45: {"eor", modeZpg},
+	0x55: {"eor", modeZpx},
+	0x4D: {"eor", modeAbs},
+	0x5D: {"eor", modeAbx},
+	0x59: {"eor", modeAby},
+	0x41: {"eor", modeIdx},
+	0x51: {"eor", modeIdy},
+
+	0xE6: {"inc", modeZpg},
+	0xF6: {"inc", modeZpx},
+	0xEE: {"inc", modeAbs},
+	0xFE: {"inc", modeAbx},
+
+	0xE8: {"inx", modeImp},
+	0xC8: {"iny", modeImp},
+
+	0x4C: {"jmp", modeAbs},
+	0x6C: {"jmp", modeInd},
+
+	0x20: {"jsr", modeAbs},
+
+	0xA9: {"lda", modeImm},
+	0xA5: {"lda", modeZpg},
+	0xB5: {"lda", modeZpx},
+	0xAD: {"lda", modeAbs},
+	0xBD: {"lda", modeAbx},
+	0xB9: {"lda", modeAby},
+	0xA1: {"lda", modeIdx},
+	0xB1: {"lda", modeIdy},
+
+	0xA2: {"ldx", modeImm},
+	0xA6: {"ldx", modeZpg},
+	0xB6: {"ldx", modeZpy},
+	0xAE: {"ldx", modeAbs},
+	0xBE: {"ldx", modeAby},
+
+	0xA0: {"ldy", modeImm},
+	0xA4: {"ldy", modeZpg},
+	0xB4: {"ldy", modeZpx},
+	0xAC: {"ldy", modeAbs},
+	0xBC: {"ldy", modeAbx},
+
+	0x4A: {"lsr", modeAcc},
+	0x46: {"lsr", modeZpg},
+	0x56: {"lsr", modeZpx},
+	0x4E: {"lsr", modeAbs},
+	0x5E: {"lsr", modeAbx},
+
+	0xEA: {"nop", modeImp},
+
+	0x09: {"ora", modeImm},
+	0x05: {"ora", modeZpg},
+	0x15: {"ora", modeZpx},
+	0x0D: {"ora", modeAbs},
+	0x1D: {"ora", modeAbx},
+	0x19: {"ora", modeAby},
+	0x01: {"ora", modeIdx},
+	0x11: {"ora", modeIdy},
+
+	0x48: {"pha", modeImp},
+	0x08: {"php", modeImp},
+	0x68: {"pla", modeImp},
+	0x28: {"plp", modeImp},
+
+	0x2A: {"rol", modeAcc},
+	0x26: {"rol", modeZpg},
+	0x36: {"rol", modeZpx},
+	0x2E: {"rol", modeAbs},
+	0x3E: {"rol", modeAbx},
+
+	0x6A: {"ror", modeAcc},
+	0x66: {"ror", modeZpg},
+	0x76: {"ror", modeZpx},
+	0x6E: {"ror", modeAbs},
+	0x7E: {"ror", modeAbx},
+
+	0x40: {"rti", modeImp},
+	0x60: {"rts", modeImp},
+
+	0xE9: {"sbc", modeImm},
+	0xE5: {"sbc", modeZpg},
+	0xF5: {"sbc", modeZpx},
+	0xED: {"sbc", modeAbs},
+	0xFD: {"sbc", modeAbx},
+	0xF9: {"sbc", modeAby},
+	0xE1: {"sbc", modeIdx},
+	0xF1: {"sbc", modeIdy},
+
+	0x38: {"sec", modeImp},
+	0xF8: {"sed", modeImp},
+	0x78: {"sei", modeImp},
+
+	0x85: {"sta", modeZpg},
+	0x95: {"sta", modeZpx},
+	0x8D: {"sta", modeAbs},
+	0x9D: {"sta", modeAbx},
+	0x99: {"sta", modeAby},
+	0x81: {"sta", modeIdx},
+	0x91: {"sta", modeIdy},
+
+	0x86: {"stx", modeZpg},
+	0x96: {"stx", modeZpy},
+	0x8E: {"stx", modeAbs},
+
+	0x84: {"sty", modeZpg},
+	0x94: {"sty", modeZpx},
+	0x8C: {"sty", modeAbs},
+
+	0xAA: {"tax", modeImp},
+	0xA8: {"tay", modeImp},
+	0xBA: {"tsx", modeImp},
+	0x8A: {"txa", modeImp},
+	0x9A: {"txs", modeImp},
+	0x98: {"tya", modeImp},
+}
+
 // initRom() initialises all ROM data to 0xFF.
 // This simulates the unprogrammed state of ROMs
 func initRom() {
@@ -231,9 +539,30 @@ func initRom() {
 	binStart = 0x0000
 }
 
-// initRam() initialises all RAM data to 0xFF. 
+// initRam() initialises all RAM data to the power-on pattern.
+// By default this is 0xFF but other patterns can be selected to
+// reproduce bugs that depend on the random power-on contents of
+// real RAM. All RAM is marked as not yet written.
 func initRam() {
+	var rnd *rand.Rand
+	if ramFill == fillRandom {
+		if ramSeed == 0 {
+			ramSeed = time.Now().UnixNano()
+		}
+		fmt.Fprintln(msgOut, "Random RAM power-on pattern seed:", ramSeed)
+		rnd = rand.New(rand.NewSource(ramSeed))
+	}
 	for i, _ := range ram {
-		ram[i] = 0xFF
+		switch ramFill {
+		case fillOnes:
+			ram[i] = 0xFF
+		case fillZero:
+			ram[i] = 0x00
+		case fillAlt:
+			ram[i] = uint8(i&1) - 1
+		case fillRandom:
+			ram[i] = uint8(rnd.Intn(0x100))
+		}
+		ramInit[i] = false
 	}
 }
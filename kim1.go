@@ -0,0 +1,398 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The KIM-1 has 1K of RAM at 0000 and two 6530 RRIOTs, each with 1K of
+// ROM, 64 bytes of RAM, an interval timer and two ports. The monitor ROM
+// image (2K for 1800-1FFF, which must be supplied by the user) holds the
+// ROM of both RRIOTs. Only 13 address lines are decoded, so the vectors
+// at FFFA-FFFF are read from the top of the monitor ROM.
+//
+//	Address    6530-003 (rriot003)  6530-002 (rriot002)
+//	ROM        1800-1BFF            1C00-1FFF
+//	RAM        1780-17BF            17C0-17FF
+//	I/O timer  1700-170F            1740-174F
+//
+// The keypad, LED display and teletype are connected to the ports of the
+// 6530-002. PB1-PB4 drive a decoder whose outputs 0-2 select the keypad
+// rows and outputs 4-9 the display digits. Pressed keys in the selected
+// row pull PA0-PA6 low. Segment data for the selected digit is driven on
+// PA0-PA6. The teletype receives on PA7 and sends on PB0, with the input
+// echoed to the output by hardware. The monitor selects teletype mode
+// when PA0 is held low.
+//
+// In keypad mode (the default), keys typed at the console press the
+// keypad keys:
+//
+//	0-9 A-F    Hex keys
+//	Ctrl-A     AD (address mode)
+//	Ctrl-D     DA (data mode)
+//	+ or space + (next address)
+//	Ctrl-G     GO
+//	Ctrl-P     PC (program counter)
+//	Ctrl-T     ST (stop, raising NMI)
+//	Ctrl-R     RS (reset)
+//
+// Each key is held down long enough for the monitor to debounce it. The
+// display is drawn in the terminal from the digits that the program has
+// lit within the last display frame, so that it goes dark when the
+// program stops scanning it, as on the real board.
+//
+// In teletype mode (mode=tty), console input is sent serially to PA7 at
+// the given baud rate (default 1200) and characters sent on PB0 are
+// decoded at the same rate and shown on the console. A RUBOUT is sent
+// after each reset so that the monitor can measure the baud rate.
+
+// KIM-1 parameters
+const (
+	kim1RomSize  = 0x800        // Monitor ROM image size
+	kim1KeyTime  = 20000        // Cycles each key is held down and released
+	kim1Latch    = 100          // Cycles a digit must be lit to be shown
+	kim1Frame    = cpuFreq / 20 // Cycles per display frame
+	kim1Settle   = 100000       // Cycles after reset before sending RUBOUT
+	kim1FrameLen = 11           // Teletype bits per character
+)
+
+// KIM-1 keypad keys other than hex digits
+const (
+	kim1KeyAD = 0x10 + iota
+	kim1KeyDA
+	kim1KeyPlus
+	kim1KeyGO
+	kim1KeyPC
+	kim1KeyST
+	kim1KeyRS
+)
+
+// kim1Keys maps console keys to keypad keys other than hex digits.
+var kim1Keys = map[uint8]int{
+	0x01: kim1KeyAD, 0x04: kim1KeyDA, '+': kim1KeyPlus, ' ': kim1KeyPlus,
+	0x07: kim1KeyGO, 0x10: kim1KeyPC, 0x14: kim1KeyST, 0x12: kim1KeyRS,
+}
+
+// kim1Term is a host model of the KIM-1 keypad, display and teletype.
+type kim1Term struct {
+	io   *riot // 6530-002
+	port *hostPort
+	tty  bool   // Teletype mode
+	bit  uint64 // Cycles per teletype bit
+
+	// Keypad
+	key    int    // Key pressed or being released (-1 if none)
+	keyUp  bool   // Key being released
+	keyEnd uint64 // Cycle clock at end of press or release
+
+	// Display
+	digit int       // Digit selected (-1 if none)
+	seg   uint8     // Segments driven for the selected digit
+	segCk uint64    // Cycle clock when the digit and segments were driven
+	segs  [6]uint8  // Segments last lit for each digit
+	lit   [6]uint64 // Cycle clock when each digit was last lit
+	shown [6]uint8  // Segments drawn for each digit
+	drawn int       // Run in which the display was last drawn (-1 if none)
+	draw  uint64    // Cycle clock of next display frame
+
+	// Teletype
+	queue   []uint8 // Characters to send before console input
+	in      int     // Character being sent to PA7 (-1 if none)
+	inCk    uint64  // Cycle clock at start of character sent
+	inNext  uint64  // Cycle clock of next character that can be sent
+	line    bool    // Level of the teletype output line
+	out     int     // Bit of character being received from PB0 (-1 if none)
+	outChar uint8   // Character being received
+	outCk   uint64  // Cycle clock at start of character received
+	outEnd  uint64  // Cycle clock at end of last character received
+}
+
+// initKim1() sets up the KIM-1 memory map, ROM and RRIOTs.
+func initKim1(spec devSpec) error {
+	if err := spec.check("rom", "mode", "baud"); err != nil {
+		return err
+	}
+	path, ok := spec.opts["rom"]
+	if !ok {
+		return fmt.Errorf("%s: rom= is required", spec.name)
+	}
+	if err := romFile(path, kim1RomSize); err != nil {
+		return err
+	}
+	mode, err := spec.opt("mode", "keypad", "tty")
+	if err != nil {
+		return err
+	}
+	baud := 1200
+	if val, ok := spec.opts["baud"]; ok {
+		if baud, err = strconv.Atoi(val); err != nil || baud < 110 || baud > 9600 {
+			return fmt.Errorf("%s: invalid baud=%s", spec.name, val)
+		}
+	}
+
+	ramTop, romBase = 0x03FF, nmiVec
+	binFiles = append(binFiles, binSpec{path: path, at: uint32(nmiVec), atSet: true,
+		off: kim1RomSize - uint32(romMax-nmiVec) - 1, length: uint32(romMax-nmiVec) + 1, lenSet: true})
+	devList = append(devList,
+		devSpec{kind: "rriot", name: "rriot003", at: 0x1700, atSet: true,
+			opts: map[string]string{"ram": "1780", "rom": "1800", "image": path, "off": "0"}},
+		devSpec{kind: "rriot", name: "rriot002", at: 0x1740, atSet: true,
+			opts: map[string]string{"ram": "17C0", "rom": "1C00", "image": path, "off": "400"}})
+	kim1Io = &kim1Term{tty: mode == "tty", bit: cpuFreq / uint64(baud)}
+	return nil
+}
+
+// startKim1() connects the keypad, display and teletype to the 6530-002
+// and the console.
+func startKim1() (err error) {
+	t := kim1Io
+	t.io = findDev("rriot002").(*riot)
+	t.port = &hostPort{out: os.Stdout}
+	if t.port.in, err = conClaim("kim1"); err != nil {
+		return
+	}
+	conRawMode = true
+	models = append(models, t)
+	if err = watchPin("rriot002.pa", t.portOut); err == nil {
+		err = watchPin("rriot002.pb", t.portOut)
+	}
+	return
+}
+
+// reset() releases the keys and blanks the display. In teletype mode,
+// a RUBOUT is sent once the monitor has started.
+func (t *kim1Term) reset() {
+	t.key, t.digit, t.in, t.out = -1, -1, -1, -1
+	t.segs, t.shown, t.drawn, t.draw = [6]uint8{}, [6]uint8{}, -1, ck
+	t.queue = nil
+	if t.tty {
+		t.queue, t.inNext = []uint8{0x7F}, ck+kim1Settle
+	}
+	t.line = true
+	t.inputs()
+}
+
+// tick() presses and releases keys, draws the display and sends and
+// receives teletype characters.
+func (t *kim1Term) tick(cycles uint64) {
+	if t.tty {
+		t.send()
+		t.recv()
+		return
+	}
+	if t.key >= 0 && ck >= t.keyEnd {
+		if t.keyUp {
+			t.key = -1
+		} else {
+			t.keyUp, t.keyEnd = true, ck+kim1KeyTime
+			t.inputs()
+		}
+	}
+	if t.key < 0 {
+		if b, ok := t.port.recv(); ok && t.press(b) {
+			return
+		}
+	}
+	t.latch()
+	if ck >= t.draw {
+		t.draw = ck + kim1Frame
+		t.show()
+	}
+}
+
+// press() presses the keypad key for a console key. It returns true if
+// the machine was reset.
+func (t *kim1Term) press(b uint8) bool {
+	key, ok := kim1Keys[b]
+	if !ok {
+		n, err := strconv.ParseUint(string(b), 16, 4)
+		if err != nil {
+			return false
+		}
+		key = int(n)
+	}
+	switch key {
+	case kim1KeyST:
+		raiseNmi()
+	case kim1KeyRS:
+		reset()
+		return true
+	default:
+		t.key, t.keyUp, t.keyEnd = key, false, ck+kim1KeyTime
+		t.inputs()
+	}
+	return false
+}
+
+// row() returns the decoder output selected by PB1-PB4.
+func (t *kim1Term) row() int {
+	return int(t.io.pin("pb")>>1) & 0x0F
+}
+
+// inputs() drives PA from the keypad or the teletype.
+func (t *kim1Term) inputs() {
+	pa := uint8(0xFF)
+	switch {
+	case t.tty:
+		pa &^= 0x01
+		if !t.inLevel() {
+			pa &^= 0x80
+		}
+	case t.key >= 0 && !t.keyUp && t.key/7 == t.row():
+		pa &^= 1 << uint(6-t.key%7)
+	}
+	t.io.setPin("pa", pa)
+}
+
+// portOut() follows changes of the 6530-002 ports.
+func (t *kim1Term) portOut(level uint8) {
+	if t.tty {
+		t.lineOut()
+		return
+	}
+	t.inputs()
+	t.latch()
+	digit, seg := t.row()-4, t.io.portA()&t.io.Ddra&0x7F
+	if digit > 5 {
+		digit = -1
+	}
+	if digit != t.digit || seg != t.seg {
+		t.digit, t.seg, t.segCk = digit, seg, ck
+	}
+}
+
+// latch() records the segments of the selected digit once they have been
+// lit long enough to be seen.
+func (t *kim1Term) latch() {
+	if t.digit >= 0 && ck-t.segCk >= kim1Latch {
+		t.segs[t.digit], t.lit[t.digit] = t.seg, ck
+	}
+}
+
+// show() draws the display if it has changed, in place of the previous
+// drawing unless other output may have intervened.
+func (t *kim1Term) show() {
+	var view [6]uint8
+	for i := range view {
+		if ck-t.lit[i] <= 2*kim1Frame {
+			view[i] = t.segs[i]
+		}
+	}
+	if t.drawn == conRuns && view == t.shown {
+		return
+	}
+	var lines [3]strings.Builder
+	for i, seg := range view {
+		sep := " "
+		if i == 4 {
+			sep = "   "
+		}
+		lines[0].WriteString(sep + " " + kim1Seg(seg, 0x01, "_") + " ")
+		lines[1].WriteString(sep + kim1Seg(seg, 0x20, "|") + kim1Seg(seg, 0x40, "_") + kim1Seg(seg, 0x02, "|"))
+		lines[2].WriteString(sep + kim1Seg(seg, 0x10, "|") + kim1Seg(seg, 0x08, "_") + kim1Seg(seg, 0x04, "|"))
+	}
+	if t.drawn == conRuns && !stepping {
+		fmt.Print("\x1b[3A")
+	}
+	fmt.Print("\r" + lines[0].String() + "\n" + lines[1].String() + "\n" + lines[2].String() + "\n")
+	t.shown, t.drawn = view, conRuns
+}
+
+// kim1Seg() returns the drawing of a segment if it is lit.
+func kim1Seg(seg uint8, mask uint8, s string) string {
+	if seg&mask == 0 {
+		return " "
+	}
+	return s
+}
+
+// inLevel() returns the level of the teletype input line (PA7).
+func (t *kim1Term) inLevel() bool {
+	if t.in < 0 {
+		return true
+	}
+	switch n := (ck - t.inCk) / t.bit; {
+	case n == 0:
+		return false
+	case n <= 8:
+		return t.in>>(n-1)&1 != 0
+	}
+	return true
+}
+
+// send() sends the next character to PA7 once the previous one has been
+// sent and the monitor has finished sending output.
+func (t *kim1Term) send() {
+	if t.in >= 0 {
+		if ck-t.inCk >= kim1FrameLen*t.bit {
+			t.in, t.inNext = -1, ck+t.bit
+		}
+		t.inputs()
+		t.lineOut()
+		return
+	}
+	if ck < t.inNext || t.out >= 0 || ck-t.outEnd < 2*kim1FrameLen*t.bit {
+		return
+	}
+	var b uint8
+	if len(t.queue) > 0 {
+		b, t.queue = t.queue[0], t.queue[1:]
+	} else if c, ok := t.port.recv(); ok {
+		b = kim1Char(c)
+	} else {
+		return
+	}
+	t.in, t.inCk = int(b), ck
+	t.inputs()
+	t.lineOut()
+}
+
+// kim1Char() converts a console key to a teletype character.
+func kim1Char(c uint8) uint8 {
+	switch {
+	case c == '\n':
+		c = '\r'
+	case c == '\b':
+		c = 0x7F
+	case c >= 'a' && c <= 'z':
+		c -= 'a' - 'A'
+	}
+	return c
+}
+
+// lineOut() follows the teletype output line, which is low while PB0 is
+// low or the input line is low (echo), and starts receiving a character
+// at the falling edge of its start bit.
+func (t *kim1Term) lineOut() {
+	line := t.io.pin("pb")&0x01 != 0 && t.inLevel()
+	if line == t.line {
+		return
+	}
+	t.line = line
+	if !line && t.out < 0 {
+		t.out, t.outChar, t.outCk = 0, 0, ck
+	}
+}
+
+// recv() samples the teletype output line in the middle of each bit and
+// shows each character received.
+func (t *kim1Term) recv() {
+	for t.out >= 0 && ck >= t.outCk+uint64(t.out+1)*t.bit+t.bit/2 {
+		if t.out < 8 {
+			if t.line {
+				t.outChar |= 1 << uint(t.out)
+			}
+			t.out++
+			continue
+		}
+		t.out, t.outEnd = -1, ck
+		switch c := t.outChar & 0x7F; {
+		case c == '\r' || c == '\n' || c >= ' ' && c < 0x7F:
+			t.port.send(c)
+		}
+	}
+}
@@ -4,192 +4,453 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 // load() loads binary data and source code.
-func load(name string) {
-	loadBin(name + ".bin")
-	loadLst(name + ".lst")
-	fmt.Println()
+// The binary file format is selected by the file extension,
+// apart from sim65 files which are recognised by their header.
+// If there is no recognised extension, a raw binary file with
+// a .bin extension is assumed. The LST file has the same name
+// as the binary file with a .lst extension. Errors in the binary
+// file are fatal.
+func load(path string) {
+	var err error
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext)
+	switch ext := strings.ToLower(ext); {
+	case isSim65(path):
+		err = loadSim65(path)
+	case ext == ".bin":
+		err = loadBin(path)
+	case ext == ".hex", ext == ".ihx":
+		err = loadHex(path)
+	case ext == ".s19", ext == ".s28", ext == ".s37", ext == ".srec", ext == ".mot":
+		err = loadSrec(path)
+	case ext == ".prg":
+		err = loadPrg(path)
+	default:
+		name = path
+		err = loadBin(path + ".bin")
+	}
+	if err != nil {
+		loadFailed(err)
+	}
+	progName = name
+	loadLst(name+".lst", msgOut)
+	loadDbg(name + ".dbg")
+	loadSyms(name + ".lbl")
+	loadSyms(name + ".vs")
+	fmt.Fprintln(msgOut)
+}
+
+// loadBins() loads raw binary files at explicit addresses
+// (see binSpec) along with any matching LST files.
+func loadBins(specs binSpecs) {
+	for _, spec := range specs {
+		if err := loadRaw(spec); err != nil {
+			loadFailed(err)
+		}
+		loadLst(strings.TrimSuffix(spec.path, filepath.Ext(spec.path))+".lst", msgOut)
+		fmt.Fprintln(msgOut)
+	}
 }
 
 // loadBin() loads raw binary data into memory.
 // (See package documentation for details)
-func loadBin(path string) {
+func loadBin(path string) error {
+	binAssumed = true
+	return loadRaw(binSpec{path: path, end: uint32(memMax), endSet: true})
+}
 
-	fmt.Println("Found binary file:", path)
+// loadRaw() loads part or all of a raw binary file into RAM or ROM
+// at the address given by the binary file specification.
+func loadRaw(spec binSpec) error {
 
-	file, err := os.Open(path)
+	fmt.Fprintln(msgOut, "Found binary file:", spec.path)
+
+	buf, err := os.ReadFile(spec.path)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer file.Close()
+	if spec.off > uint32(len(buf)) {
+		return fmt.Errorf("%s: offset %X is beyond end of file", spec.path, spec.off)
+	}
+	buf = buf[spec.off:]
+	if spec.lenSet {
+		if spec.length > uint32(len(buf)) {
+			return fmt.Errorf("%s: length %X is beyond end of file", spec.path, spec.length)
+		}
+		buf = buf[:spec.length]
+	}
+	count := uint32(len(buf))
+	addr := spec.at
+	if spec.endSet {
+		if count > spec.end+1 {
+			return fmt.Errorf("%s: %d bytes do not fit below end address %s",
+				spec.path, count, fmtWord(uint16(spec.end)))
+		}
+		addr = spec.end + 1 - count
+	}
+	fmt.Fprintln(msgOut, "Loading binary data from "+fmtWord(uint16(addr))+" to "+fmtWord(uint16(addr+count-1))+"...")
 
-	buf := make([]uint8, memSize)
-	count, err := file.Read(buf)
-	if err != nil && err != io.EOF {
-		panic(err)
+	loadBegin(spec.path)
+	if err = loadData(addr, buf); err != nil {
+		return fmt.Errorf("%s: %v", spec.path, err)
 	}
+	loadEnd()
+	fmt.Fprintln(msgOut, "Binary file loaded\n")
+	return nil
+}
 
-	flashing = true
-	binStart = memMax - uint16(count) + 1
-	addr := binStart
-	fmt.Println("Loading binary data from " + fmtWord(addr) + " to " + fmtWord(memMax) + "...")
+// loadPrg() loads a Commodore PRG file into RAM. The first two bytes
+// of the file give the load address of the remaining bytes (in little-
+// endian order). If requested, the SYS address of a BASIC stub at the
+// start of the program is used as the start address.
+func loadPrg(path string) error {
 
-	for i := 0; i < count; i++ {
-		data := buf[i]
-		writeByte(addr, data)
-		addr++
+	fmt.Fprintln(msgOut, "Found PRG file:", path)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(buf) < 2 {
+		return fmt.Errorf("%s: missing load address", path)
 	}
+	addr := uint32(buf[0]) | uint32(buf[1])<<8
+	buf = buf[2:]
+	end := addr + uint32(len(buf))
+	if addr < uint32(ramMin) || end > uint32(ramTop)+1 {
+		return fmt.Errorf("%s: %s-%s is outside RAM", path, fmtWord(uint16(addr)), fmtWord(uint16(end-1)))
+	}
+	fmt.Fprintln(msgOut, "Loading program from "+fmtWord(uint16(addr))+" to "+fmtWord(uint16(end-1))+"...")
 
-	flashing = false
-	fmt.Println("Binary file loaded\n")
+	loadBegin(path)
+	if err = loadData(addr, buf); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	loadEnd()
+
+	if entrySys {
+		sys, ok := basicSys(buf)
+		if !ok {
+			return fmt.Errorf("%s: no SYS address found in BASIC stub", path)
+		}
+		fmt.Fprintln(msgOut, "BASIC stub SYS address:", fmtWord(sys))
+		entryPc, entrySet = sys, true
+	}
+	fmt.Fprintln(msgOut, "PRG file loaded\n")
+	return nil
 }
 
-// loadLst() loads source code from the LST file. 
-// (See package documentation for details)
-func loadLst(path string) {
+// basicSys() finds the address of the first SYS statement in the
+// first line of a tokenised BASIC program. The line starts with a
+// link address and line number, followed by the SYS token ($9E) and
+// a decimal address, optionally in brackets.
+func basicSys(prog []uint8) (addr uint16, ok bool) {
+	if len(prog) < 5 {
+		return
+	}
+	line := prog[4:]
+	for i, b := range line {
+		if b == 0x00 {
+			break
+		}
+		if b != 0x9E {
+			continue
+		}
+		digits := strings.TrimLeft(string(line[i+1:]), " (")
+		n := 0
+		for n < len(digits) && digits[n] >= '0' && digits[n] <= '9' {
+			n++
+		}
+		val, err := strconv.ParseUint(digits[:n], 10, 16)
+		if err == nil {
+			addr, ok = uint16(val), true
+		}
+		break
+	}
+	return
+}
 
-	var comment, label string
-	var sd srcData
+// loadHex() loads an Intel HEX file into memory.
+// Each data record is placed at its stated address. The start
+// address record (if any) optionally overrides the reset vector.
+// Extended address records must not address beyond $FFFF.
+func loadHex(path string) error {
+	fmt.Fprintln(msgOut, "Found Intel HEX file:", path)
+	var base uint32
+	return loadText(path, func(line string) (err error) {
+		if !strings.HasPrefix(line, ":") {
+			return fmt.Errorf("record does not start with ':'")
+		}
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return fmt.Errorf("invalid hex digits")
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return fmt.Errorf("record length does not match byte count")
+		}
+		sum := uint8(0)
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			last := rec[len(rec)-1]
+			return fmt.Errorf("checksum error (expected %s, found %s)",
+				fmtByte(last-sum), fmtByte(last))
+		}
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4 : len(rec)-1]
+		sizes := map[uint8]int{0x02: 2, 0x03: 4, 0x04: 2, 0x05: 4}
+		if size, ok := sizes[rec[3]]; ok && len(data) != size {
+			return fmt.Errorf("record type %s must have %d data bytes", fmtByte(rec[3]), size)
+		}
+		switch rec[3] {
+		case 0x00:
+			err = loadData(base+addr, data)
+		case 0x01:
+			err = io.EOF
+		case 0x02:
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case 0x04:
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case 0x03:
+			loadStart(uint32(data[2])<<8 | uint32(data[3]))
+		case 0x05:
+			loadStart(uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3]))
+		default:
+			err = fmt.Errorf("unknown record type %s", fmtByte(rec[3]))
+		}
+		return
+	})
+}
 
+// loadSrec() loads a Motorola S-record file into memory.
+// Each data record (S1, S2 or S3) is placed at its stated address.
+// The start address record (S7, S8 or S9) optionally overrides the
+// reset vector. Header and count records are ignored.
+func loadSrec(path string) error {
+	fmt.Fprintln(msgOut, "Found S-record file:", path)
+	return loadText(path, func(line string) (err error) {
+		if len(line) < 2 || line[0] != 'S' && line[0] != 's' {
+			return fmt.Errorf("record does not start with 'S'")
+		}
+		rec, err := hex.DecodeString(line[2:])
+		if err != nil {
+			return fmt.Errorf("invalid hex digits")
+		}
+		if len(rec) < 1 || len(rec) != int(rec[0])+1 {
+			return fmt.Errorf("record length does not match byte count")
+		}
+		sum := uint8(0)
+		for _, b := range rec[:len(rec)-1] {
+			sum += b
+		}
+		if last := rec[len(rec)-1]; ^sum != last {
+			return fmt.Errorf("checksum error (expected %s, found %s)",
+				fmtByte(^sum), fmtByte(last))
+		}
+		addrLen := 0
+		switch line[1] {
+		case '0', '1', '5', '9':
+			addrLen = 2
+		case '2', '6', '8':
+			addrLen = 3
+		case '3', '7':
+			addrLen = 4
+		default:
+			return fmt.Errorf("unknown record type S%c", line[1])
+		}
+		if len(rec) < addrLen+2 {
+			return fmt.Errorf("record too short for S%c", line[1])
+		}
+		addr := uint32(0)
+		for _, b := range rec[1 : addrLen+1] {
+			addr = addr<<8 | uint32(b)
+		}
+		data := rec[addrLen+1 : len(rec)-1]
+		switch line[1] {
+		case '1', '2', '3':
+			err = loadData(addr, data)
+		case '7', '8', '9':
+			loadStart(addr)
+			err = io.EOF
+		}
+		return
+	})
+}
+
+// loadText() reads a text file line by line, passing each non-blank
+// line to a record parser. Any error other than io.EOF (which ends
+// the file early) stops loading and is returned with its line number.
+func loadText(path string, parse func(line string) error) error {
 	file, err := os.Open(path)
 	if err != nil {
-		return
+		return err
 	}
 	defer file.Close()
 
-	fmt.Println("Found LST file:", path)
-	fileBuf := bufio.NewReader(file)
+	loadBegin(path)
+	scanner := bufio.NewScanner(file)
 	lineCount := 0
-	srcCount := 0
-	errCount := 0
-
-getLine:
-	for {
-		line, err := fileBuf.ReadString('\n')
+	for scanner.Scan() {
+		lineCount++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		err = parse(line)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			break getLine
+			return fmt.Errorf("%s:%d: %v", path, lineCount, err)
 		}
-		lineCount++
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	seg := loadEnd()
+
+	if seg.count == 0 {
+		return fmt.Errorf("%s: no data records found", path)
+	}
+	fmt.Fprintln(msgOut, "Loaded", seg.count, "bytes from "+fmtWord(uint16(seg.lo))+" to "+fmtWord(uint16(seg.hi)))
+	fmt.Fprintln(msgOut, "File loaded\n")
+	return nil
+}
+
+// loadFailed() reports an error in a file being loaded and exits.
+func loadFailed(err error) {
+	fmt.Fprintln(msgOut, "Load failed:", err)
+	os.Exit(1)
+}
 
-		// extract trailing comment first
-		span := strings.TrimSpace(line)
-		i := strings.LastIndex(span, ";")
-		j := strings.LastIndex(span, "\"")
-		if i > 0 && i > j {
-			comment = strings.TrimSpace(span[i+1:])
-			span = strings.TrimSpace(span[:i])
-		} else {
-			comment = ""
+// loadBegin() starts a new load segment. Data for the segment is
+// written by loadData() and the segment is completed by loadEnd().
+// ROM is writeable while a segment is being loaded.
+func loadBegin(path string) {
+	loadSegs = append(loadSegs, loadSeg{path: path, lo: memSize})
+	flashing = true
+}
+
+// loadData() writes data to memory as part of the current load
+// segment. Data may not extend beyond the top of memory or overlap
+// data loaded by any other segment.
+func loadData(addr uint32, data []uint8) error {
+	end := addr + uint32(len(data))
+	if end > memSize {
+		return fmt.Errorf("data at %X extends beyond %s", addr, fmtWord(memMax))
+	}
+	n := len(loadSegs)
+	seg := &loadSegs[n-1]
+	for i, b := range data {
+		a := uint16(addr) + uint16(i)
+		if owner := loadOwner[a]; owner != 0 && int(owner) != n {
+			return fmt.Errorf("data at %s overlaps %s", fmtWord(a), loadSegs[owner-1].path)
+		}
+		loadOwner[a] = uint16(n)
+		writeByte(a, b)
+	}
+	if len(data) > 0 {
+		if addr < seg.lo {
+			seg.lo = addr
 		}
+		if end-1 > seg.hi {
+			seg.hi = end - 1
+		}
+		seg.count += len(data)
+	}
+	return nil
+}
 
-		// extract fields to left of comment
-		fields := strings.Fields(span)
-		fieldCount := len(fields)
-		if fieldCount < 3 {
-			continue getLine
+// loadEnd() completes the current load segment. The first address
+// of the first segment loaded is used as the start of the listing.
+func loadEnd() (seg loadSeg) {
+	flashing = false
+	seg = loadSegs[len(loadSegs)-1]
+	if len(loadSegs) == 1 && seg.count > 0 {
+		binStart = uint16(seg.lo)
+	}
+	return
+}
+
+// loadReport() prints a summary of all loaded segments.
+func loadReport() {
+	fmt.Fprintln(msgOut, "Load Summary...\n")
+	for _, seg := range loadSegs {
+		if seg.count == 0 {
+			continue
 		}
-		if fields[1] != ":" {
-			continue getLine
+		lo, hi := uint16(seg.lo), uint16(seg.hi)
+		region := "RAM+ROM"
+		switch {
+		case lo >= ramMin && hi <= ramTop:
+			region = "RAM"
+		case lo >= romBase && hi <= romMax:
+			region = "ROM"
 		}
+		fmt.Fprintf(msgOut, "%s-%s %5d bytes %-5s %s\n", fmtWord(lo), fmtWord(hi), seg.count, region, seg.path)
+	}
+	fmt.Fprintln(msgOut, "\nEnd of Load Summary\n")
+}
 
-		// extract address
-		hexAddr := fields[0]
-		if len(hexAddr) != 4 {
-			continue getLine
+// String() formats binary file specifications for the flag package.
+func (specs *binSpecs) String() string {
+	return fmt.Sprint(*specs)
+}
+
+// Set() parses a binary file specification for the flag package.
+// The format is path,at=hhhh or path,end=hhhh optionally followed
+// by ,off=hhhh and/or ,len=hhhh to load part of the file.
+func (specs *binSpecs) Set(val string) error {
+	fields := strings.Split(val, ",")
+	spec := binSpec{path: fields[0]}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=value: %s", field)
 		}
-		parAddr, err := strconv.ParseUint(hexAddr, 16, 16)
+		num, err := parseHex(kv[1], 32)
 		if err != nil {
-			continue getLine
-		}
-		addr := uint16(parAddr)
-
-		// retrieve existing source for this address (if any)
-		// e.g. there may already have been an address label
-		// on the previous line with zero bytes of actual code.
-		// If there is no existing source for this address then
-		// we are starting off with blank source data.
-
-		sd = src[addr]
-
-		// concatentate comments from multiple lines
-		if len(comment) > 0 {
-			if len(sd.comment) > 0 {
-				sd.comment += " - "
-			}
-			sd.comment += comment
-		}
-
-		// check for a label only line of source  with zero bytes
-		// ignore > symbol masquerading as a label
-		if len(fields) == 3 {
-
-			label = fields[2]
-			if label != ">" {
-				sd.label = label
-			}
-
-		} else {
-
-			// extract ByteCount and verify code bytes
-			hexCode := fields[2]
-			charCount := len(hexCode)
-			if charCount > 6 {
-				continue getLine
-			}
-			if charCount%2 != 0 {
-				continue getLine
-			}
-			sd.byteCount = charCount / 2
-			for i = 0; i < sd.byteCount; i++ {
-				j = 2 * i
-				pbyte, err := strconv.ParseUint(hexCode[j:j+2], 16, 8)
-				if err != nil {
-					continue getLine
-				}
-				if uint8(pbyte) != readByte(addr+uint16(i)) {
-					errCount += 1
-					continue getLine
-				}
-			}
-
-			// extract label, mnemomic and operand
-			if mnems[fields[3]] {
-				sd.mnem = fields[3]
-				i = 4
-			} else {
-				if fieldCount < 5 {
-					continue getLine
-				}
-				if !mnems[fields[4]] {
-					continue getLine
-				}
-				label = fields[3]
-				if label != ">" {
-					sd.label = label
-				}
-				sd.mnem = fields[4]
-				i = 5
-			}
-			sd.operand = strings.Join(fields[i:], "")
-		}
-		src[addr] = sd
-		srcCount++
-	}
-
-	fmt.Println(lineCount, "lines processed")
-	fmt.Println(srcCount, "lines of valid source obtained\n")
-	if errCount > 0 {
-		fmt.Println("WARNING:", errCount, "code errors found.\n"+
-			"Probable cause: Binary file mis-alignment.\n"+
-			"Last address of binary data is assumed to be $FFFF.\n"+
-			"For correct binary alignment, source must end at top-of-memory.\n"+
-			"Solution: Specify last vector (IRQ) at $FFFE.\n")
+			return err
+		}
+		switch kv[0] {
+		case "at":
+			spec.at, spec.atSet = uint32(num), true
+		case "end":
+			spec.end, spec.endSet = uint32(num), true
+		case "off":
+			spec.off = uint32(num)
+		case "len":
+			spec.length, spec.lenSet = uint32(num), true
+		default:
+			return fmt.Errorf("unknown key: %s", kv[0])
+		}
+	}
+	switch {
+	case spec.atSet == spec.endSet:
+		return fmt.Errorf("exactly one of at= or end= is required")
+	case spec.atSet && spec.at > uint32(memMax), spec.endSet && spec.end > uint32(memMax):
+		return fmt.Errorf("address beyond %s", fmtWord(memMax))
+	}
+	*specs = append(*specs, spec)
+	return nil
+}
+
+// loadStart() records the start address from a loaded file.
+// It overrides the reset vector only when requested.
+func loadStart(addr uint32) {
+	fmt.Fprintf(msgOut, "Start address: %04X\n", addr)
+	if useStart {
+		entryPc, entrySet = uint16(addr), true
 	}
 }
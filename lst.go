@@ -0,0 +1,441 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listings from different assemblers are handled by separate parsers.
+// Each parser extracts the address, code bytes and source (if any) from
+// a line of its own listing format and ignores all other lines. The
+// format of an LST file is detected by trying every parser and choosing
+// the one whose code bytes match the loaded binary data most often.
+
+// lstLine is a line of source parsed from an LST file.
+type lstLine struct {
+	addr    uint16
+	reloc   bool  // Address is relative to the start of the loaded data
+	code    []int // Code bytes (-1 for bytes still to be relocated)
+	label   string
+	mnem    string
+	operand string
+	comment string
+}
+
+// lstParser parses the listing format of a particular assembler.
+// parse() returns false for lines that do not contain source
+// at an address.
+type lstParser interface {
+	name() string
+	parse(line string) (ll lstLine, ok bool)
+}
+
+// loadLst() loads source code from the LST file, reporting progress
+// to the given writer. (See package documentation for details)
+func loadLst(path string, out io.Writer) {
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintln(out, "Found LST file:", path)
+	lines := strings.Split(strings.ReplaceAll(string(buf), "\r\n", "\n"), "\n")
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	// relocatable addresses are relative to the most recently loaded data
+	base := uint16(0)
+	if len(loadSegs) > 0 {
+		base = uint16(loadSegs[len(loadSegs)-1].lo)
+	}
+	p := detectLst(lines, base)
+	fmt.Fprintln(out, "Listing format:", p.name())
+	srcCount := 0
+	errCount := 0
+	symCount := 0
+	inSyms := false
+
+getLine:
+	for _, line := range lines {
+
+		// symbol table (as65 -t) is listed between the two passes
+		// under a "Symbol Table" heading ruled off with dashes and
+		// ends with a count of labels used (see symRow)
+		if strings.TrimSpace(strings.Trim(line, "-")) == "Symbol Table" {
+			inSyms = true
+		}
+		if inSyms {
+			if f := strings.Fields(line); len(f) == 3 && f[1] == "labels" && f[2] == "used" {
+				inSyms = false
+			}
+			symCount += parseSyms(line)
+			continue getLine
+		}
+
+		ll, ok := p.parse(line)
+		if !ok || len(ll.code) == 0 && len(ll.label) == 0 && len(ll.comment) == 0 {
+			continue getLine
+		}
+		if ll.reloc {
+			ll.addr += base
+		}
+
+		// retrieve existing source for this address (if any)
+		// e.g. there may already have been an address label
+		// on the previous line with zero bytes of actual code.
+		// If there is no existing source for this address then
+		// we are starting off with blank source data.
+
+		sd := src[ll.addr]
+
+		// concatentate comments from multiple lines
+		if len(ll.comment) > 0 {
+			if len(sd.comment) > 0 {
+				sd.comment += " - "
+			}
+			sd.comment += ll.comment
+		}
+
+		// ignore > symbol masquerading as a label
+		if len(ll.label) > 0 && ll.label != ">" {
+			sd.label = ll.label
+		}
+
+		// verify code bytes (if not a label only line)
+		if len(ll.code) > 0 {
+			if len(ll.code) > 3 {
+				continue getLine
+			}
+			if !lstMatch(ll) {
+				errCount += 1
+				continue getLine
+			}
+			if len(ll.mnem) == 0 {
+				continue getLine
+			}
+			sd.byteCount = len(ll.code)
+			sd.mnem = ll.mnem
+			sd.operand = ll.operand
+		}
+		src[ll.addr] = sd
+		srcCount++
+		if len(sd.label) > 0 {
+			addSym(sd.label, ll.addr)
+		}
+	}
+
+	fmt.Fprintln(out, len(lines), "lines processed")
+	fmt.Fprintln(out, srcCount, "lines of valid source obtained")
+	if symCount > 0 {
+		fmt.Fprintln(out, symCount, "symbols found in symbol table")
+	}
+	fmt.Fprintln(out)
+	if errCount > 0 {
+		fmt.Fprintln(out, "WARNING:", errCount, "code errors found.")
+		if binAssumed {
+			fmt.Fprintln(out, "Probable cause: Binary file mis-alignment.\n"+
+				"Last address of binary data is assumed to be $FFFF.\n"+
+				"For correct binary alignment, source must end at top-of-memory.\n"+
+				"Solution: Specify last vector (IRQ) at $FFFE.\n")
+		} else {
+			fmt.Fprintln(out, "Probable cause: LST file does not match binary file.\n")
+		}
+	}
+}
+
+// detectLst() selects the parser that finds the most lines of code
+// matching memory. Ties are broken by the number of lines parsed and
+// then by the order of lstParsers, so that as65 remains the default.
+func detectLst(lines []string, base uint16) (best lstParser) {
+	bestMatched, bestParsed := -1, -1
+	for _, p := range lstParsers {
+		matched, parsed := 0, 0
+		for _, line := range lines {
+			ll, ok := p.parse(line)
+			if !ok {
+				continue
+			}
+			parsed++
+			if ll.reloc {
+				ll.addr += base
+			}
+			if len(ll.code) > 0 && lstMatch(ll) {
+				matched++
+			}
+		}
+		if matched > bestMatched || matched == bestMatched && parsed > bestParsed {
+			best, bestMatched, bestParsed = p, matched, parsed
+		}
+	}
+	return
+}
+
+// lstMatch() verifies the code bytes of a line against memory.
+// Bytes still to be relocated match any value.
+func lstMatch(ll lstLine) bool {
+	for i, b := range ll.code {
+		if b >= 0 && uint8(b) != readByte(ll.addr+uint16(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// lstComment() splits a trailing comment from a line of source.
+func lstComment(line string) (span string, comment string) {
+	span = strings.TrimSpace(line)
+	i := strings.LastIndex(span, ";")
+	j := strings.LastIndex(span, "\"")
+	if i > 0 && i > j {
+		comment = strings.TrimSpace(span[i+1:])
+		span = strings.TrimSpace(span[:i])
+	}
+	return
+}
+
+// lstSource() extracts the label, mnemonic and operand from a line of
+// source. A label may be followed by a colon. Source with no recognised
+// mnemonic (such as a pseudo-instruction) only yields a label.
+func lstSource(ll *lstLine, line string) {
+	var span string
+	span, ll.comment = lstComment(line)
+	fields := strings.Fields(span)
+	switch {
+	case len(fields) == 0:
+	case isMnem(fields[0]):
+		ll.mnem = fields[0]
+		ll.operand = strings.Join(fields[1:], "")
+	case len(fields) > 1 && isMnem(fields[1]):
+		ll.label = strings.TrimSuffix(fields[0], ":")
+		ll.mnem = fields[1]
+		ll.operand = strings.Join(fields[2:], "")
+	case len(fields) == 1:
+		ll.label = strings.TrimSuffix(fields[0], ":")
+	}
+}
+
+// isMnem() checks for a 6502 mnemonic in either case.
+func isMnem(s string) bool {
+	return mnems[strings.ToLower(s)]
+}
+
+// lstField() splits the first whitespace delimited field from a line.
+func lstField(line string) (field string, rest string) {
+	line = strings.TrimLeft(line, " \t")
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i:]
+}
+
+// lstHex() converts a string of hex digit pairs to code bytes.
+func lstHex(s string) (code []int, ok bool) {
+	if len(s) == 0 || len(s)%2 != 0 {
+		return
+	}
+	for i := 0; i < len(s); i += 2 {
+		b, err := strconv.ParseUint(s[i:i+2], 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		code = append(code, int(b))
+	}
+	return code, true
+}
+
+// lstBytes() extracts leading code bytes separated by whitespace.
+// Bytes still to be relocated are shown as rr by ca65.
+func lstBytes(line string) (code []int, rest string) {
+	rest = line
+	for {
+		field, next := lstField(rest)
+		if field == "rr" {
+			code = append(code, -1)
+		} else if b, ok := lstHex(field); ok && len(b) == 1 {
+			code = append(code, b[0])
+		} else {
+			return
+		}
+		rest = next
+	}
+}
+
+// as65Lst parses as65 -l listings:
+//
+//	f00d : 2016f0  tst_ok   jsr done  ; success
+type as65Lst struct{}
+
+func (as65Lst) name() string { return "as65" }
+
+func (as65Lst) parse(line string) (ll lstLine, ok bool) {
+	span, comment := lstComment(line)
+	fields := strings.Fields(span)
+	if len(fields) < 3 || fields[1] != ":" || len(fields[0]) != 4 {
+		return
+	}
+	addr, err := strconv.ParseUint(fields[0], 16, 16)
+	if err != nil {
+		return
+	}
+	ll.addr = uint16(addr)
+	ll.comment = comment
+
+	// check for a label only line of source with zero bytes
+	if len(fields) == 3 {
+		ll.label = fields[2]
+		return ll, true
+	}
+	if ll.code, ok = lstHex(fields[2]); !ok {
+		return
+	}
+	if isMnem(fields[3]) {
+		ll.mnem = fields[3]
+		ll.operand = strings.Join(fields[4:], "")
+	} else if len(fields) > 4 && isMnem(fields[4]) {
+		ll.label = fields[3]
+		ll.mnem = fields[4]
+		ll.operand = strings.Join(fields[5:], "")
+	}
+	return
+}
+
+// ca65Lst parses ca65 -l listings. Addresses followed by r are
+// relative to the start of the segment, which is assumed to be
+// the start of the loaded data:
+//
+//	000002r 1  E8           loop:   inx
+type ca65Lst struct{}
+
+func (ca65Lst) name() string { return "ca65" }
+
+func (ca65Lst) parse(line string) (ll lstLine, ok bool) {
+	if len(line) < 9 || line[7] != ' ' {
+		return
+	}
+	addr, err := strconv.ParseUint(line[:6], 16, 32)
+	if err != nil || addr > uint64(memMax) {
+		return
+	}
+	switch line[6] {
+	case 'r':
+		ll.reloc = true
+	case ' ':
+	default:
+		return
+	}
+	ll.addr = uint16(addr)
+	level, rest := lstField(line[8:])
+	if _, err = strconv.Atoi(level); err != nil {
+		return
+	}
+	ll.code, rest = lstBytes(rest)
+	lstSource(&ll, rest)
+	return ll, true
+}
+
+// tassLst parses 64tass --list listings, with or without the
+// monitor (disassembly) column:
+//
+//	.0202	e8		inx		loop	inx
+type tassLst struct{}
+
+func (tassLst) name() string { return "64tass" }
+
+func (tassLst) parse(line string) (ll lstLine, ok bool) {
+	field, rest := lstField(line)
+	if len(field) != 5 || field[0] != '.' {
+		return
+	}
+	addr, err := strconv.ParseUint(field[1:], 16, 16)
+	if err != nil {
+		return
+	}
+	ll.addr = uint16(addr)
+	ll.code, rest = lstBytes(rest)
+
+	// The monitor column (if present) is a disassembly of the code,
+	// which is followed by the source. Without it, the source itself
+	// may start with a mnemonic, so the monitor column is only skipped
+	// if an instruction is also found in the rest of the line.
+	var parts []string
+	for _, part := range strings.Split(rest, "\t") {
+		if len(strings.TrimSpace(part)) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	if len(ll.code) > 0 && len(parts) > 1 {
+		if mnem, _ := lstField(parts[0]); isMnem(mnem) {
+			after := ll
+			lstSource(&after, strings.Join(parts[1:], "\t"))
+			if len(after.mnem) > 0 {
+				return after, true
+			}
+		}
+	}
+	lstSource(&ll, rest)
+	return ll, true
+}
+
+// acmeLst parses ACME -r report files:
+//
+//	3  0202 e8                 loop	inx
+type acmeLst struct{}
+
+func (acmeLst) name() string { return "ACME" }
+
+func (acmeLst) parse(line string) (ll lstLine, ok bool) {
+	num, rest := lstField(line)
+	if _, err := strconv.Atoi(num); err != nil {
+		return
+	}
+	field, rest := lstField(rest)
+	if len(field) != 4 {
+		return
+	}
+	addr, err := strconv.ParseUint(field, 16, 16)
+	if err != nil {
+		return
+	}
+	ll.addr = uint16(addr)
+	field, next := lstField(rest)
+	if ll.code, ok = lstHex(field); ok {
+		rest = next
+	}
+	lstSource(&ll, rest)
+	return ll, true
+}
+
+// xaLst parses xa -P listings, where each address is prefixed
+// by its segment:
+//
+//	3 A:0202  e8                  loop      inx
+type xaLst struct{}
+
+func (xaLst) name() string { return "xa" }
+
+func (xaLst) parse(line string) (ll lstLine, ok bool) {
+	num, rest := lstField(line)
+	if _, err := strconv.Atoi(num); err != nil {
+		return
+	}
+	field, rest := lstField(rest)
+	if len(field) != 6 || field[1] != ':' {
+		return
+	}
+	addr, err := strconv.ParseUint(field[2:], 16, 16)
+	if err != nil {
+		return
+	}
+	ll.addr = uint16(addr)
+	ll.code, rest = lstBytes(rest)
+	lstSource(&ll, rest)
+	return ll, true
+}
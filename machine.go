@@ -0,0 +1,83 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A machine profile replaces the default memory map (RAM at 0000-7FFF and
+// ROM at 8000-FFFF) with that of a particular machine, loads its ROM and
+// registers its devices along with host models of its keyboard, display
+// and so on. The profile is given with -machine as kind[,options].
+
+// initMachine() sets up the machine profile given on the command line.
+// It must be called once the command line is parsed and before anything
+// is loaded.
+func initMachine() {
+	if len(machArg) == 0 {
+		return
+	}
+	fields := strings.Split(machArg, ",")
+	spec := devSpec{kind: strings.ToLower(fields[0]), opts: make(map[string]string)}
+	spec.name = spec.kind
+	kind, ok := machKinds[spec.kind]
+	if !ok {
+		argErr("machine", machArg)
+	}
+	var err error
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("expected key=value: %s", field)
+			break
+		}
+		spec.opts[kv[0]] = kv[1]
+	}
+	if err == nil {
+		err = kind.init(spec)
+	}
+	if err != nil {
+		fmt.Fprintln(msgOut, "Cannot set up machine:", err)
+		fmt.Fprintln(msgOut, "Usage: -machine", kind.usage)
+		os.Exit(1)
+	}
+	machine = kind
+}
+
+// startMachine() attaches the host models of the machine profile (if any).
+// It must be called once the devices are registered.
+func startMachine() {
+	if machine.start == nil {
+		return
+	}
+	if err := machine.start(); err != nil {
+		fmt.Fprintln(msgOut, "Cannot start machine:", err)
+		os.Exit(1)
+	}
+}
+
+// machKindNames() lists the machine profiles that can be given with -machine.
+func machKindNames() string {
+	var names []string
+	for name := range machKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// romFile() checks that a ROM image fits in the given number of bytes.
+func romFile(path string, size int64) error {
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return err
+	case info.Size() == 0 || info.Size() > size:
+		return fmt.Errorf("%s: ROM image must be 1 to %d bytes", path, size)
+	}
+	return nil
+}
@@ -3,22 +3,75 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 )
 
 // main() starts up emulator.
 func main() {
 
-	fmt.Println("\nEmulator Initialising\n")
+	initArgs()
+	if diffMode {
+		diffMain(flag.Arg(0), flag.Arg(1), jsonOut)
+		return
+	}
+
+	// sim65 programs have the standard output to themselves
+	if len(progPath) > 0 && isSim65(progPath) {
+		msgOut = os.Stderr
+	}
+	fmt.Fprintln(msgOut, "\nEmulator Initialising\n")
 
 	initAll()
-	load("test")
+	if len(progPath) > 0 {
+		load(progPath)
+	}
+	if len(progArgs) > 0 && !sim65Mode {
+		fmt.Fprintln(msgOut, "Program arguments are only passed to sim65 programs")
+		os.Exit(1)
+	}
+	loadBins(binFiles)
+	if len(dbgPath) > 0 {
+		loadDbg(dbgPath)
+		if dbg == nil {
+			fmt.Fprintln(msgOut, "Cannot open dbg file:", dbgPath)
+			os.Exit(1)
+		}
+	}
+	for _, spec := range o65Files {
+		if err := loadO65(spec); err != nil {
+			loadFailed(err)
+		}
+	}
+	for _, path := range symFiles {
+		if !loadSyms(path) {
+			fmt.Fprintln(msgOut, "Cannot open symbol file:", path)
+			os.Exit(1)
+		}
+	}
+	loadReport()
+	initDevs(devList)
+	startMachine()
 	reset()
+	if len(snapPath) > 0 {
+		if err := restoreSnap(snapPath); err != nil {
+			fmt.Fprintln(msgOut, err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(msgOut, "Restored snapshot:", snapPath, "\n")
+	}
 	active = true
+	if !stepping {
+		conRun()
+	}
 	opLoop()
 	active = false
+	conStop()
+	reportRomWrites()
 
-	fmt.Println("\nEmulator Terminated\n")
+	fmt.Fprintln(msgOut, "\nEmulator Terminated\n")
+	os.Exit(exitCode)
 }
 
 // opLoop() reads and executes each CPU instruction in turn
@@ -30,16 +83,28 @@ getOp:
 		if ck >= syncNextCk {
 			sync()
 		}
+		if len(devs) > 0 {
+			devCycle()
+		}
+		opPc = pc
 		op = readByte(pc)
+		markCode()
 		if debugging {
 			chkBreak()
+			if quitting {
+				fmt.Fprintln(msgOut, "Run ended with code", exitCode)
+				break getOp
+			}
 			if stepping {
+				if !held {
+					held = true
+					breakSnap()
+				}
+				dbgStep()
 			getCmd:
 				for {
-					cmd := ""
 					fmt.Print(fmtState() + " >")
-					fmt.Scanln(&cmd)
-					pa := execCmd(cmd)
+					pa := execCmd(readCmd())
 					switch pa {
 					case postActionHold:
 						continue getCmd
@@ -51,13 +116,34 @@ getOp:
 						break getOp
 					}
 				}
+			} else {
+				held = false
 			}
 		}
 		opFunc := opFuncs[op]
+		if sim65Hook(pc) {
+			opFunc = sim65Call
+		}
 		if opFunc == nil {
-			fmt.Println("ILLEGAL INSTRUCTION at", fmtPc(), ":", fmtOp())
+			fmt.Fprintln(msgOut, "ILLEGAL INSTRUCTION at", fmtPc(), ":", fmtOp())
+			exitCode = 1
 			break getOp
 		}
+		inOp = true
 		opFunc()
+		inOp = false
+		if refPend != nil {
+			endRef()
+		}
+		if quitting {
+			fmt.Fprintln(msgOut, "\nExit requested with code", exitCode)
+			break getOp
+		}
 	}
 }
+
+// requestExit() requests that the emulator terminates with an exit code
+// once the current instruction has finished.
+func requestExit(code int) {
+	exitCode, quitting = code, true
+}
@@ -0,0 +1,329 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The o65 relocatable object format is described in detail at
+// http://www.6502.org/users/andre/o65/fileformat.html. An o65 file
+// consists of a header, the text and data segments, a list of
+// undefined references, relocation tables for the text and data
+// segments and a list of exported globals. Files are relocated as
+// they are loaded, so that any base addresses can be chosen for the
+// text, data, bss and zero page segments. Object files that still
+// contain undefined references cannot be loaded as there is no
+// linking stage.
+
+// o65 mode bits
+const (
+	o65Mode816   = 0x8000 // 65816 code
+	o65ModePage  = 0x4000 // Page-wise relocation
+	o65ModeLong  = 0x2000 // 32-bit sizes and addresses
+	o65ModeChain = 0x0400 // Another file follows
+	o65ModeZero  = 0x0200 // Clear bss segment
+)
+
+// o65 segment ids
+const (
+	o65SegUndef = 0
+	o65SegAbs   = 1
+	o65SegText  = 2
+	o65SegData  = 3
+	o65SegBss   = 4
+	o65SegZero  = 5
+)
+
+// o65 relocation types
+const (
+	o65RelWord   = 0x80
+	o65RelHigh   = 0x40
+	o65RelLow    = 0x20
+	o65RelSegAdr = 0xC0
+	o65RelSeg    = 0xA0
+)
+
+// o65Reader reads little-endian fields from an o65 file image.
+// The first error encountered is retained and all later reads
+// return zero.
+type o65Reader struct {
+	buf  []uint8
+	pos  int
+	long bool // Addresses and sizes are 32-bit
+	err  error
+}
+
+func (r *o65Reader) bytes(n int) (b []uint8) {
+	if r.err == nil && r.pos+n > len(r.buf) {
+		r.err = fmt.Errorf("unexpected end of file at offset %X", r.pos)
+	}
+	if r.err != nil {
+		return make([]uint8, n)
+	}
+	b = r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return
+}
+
+func (r *o65Reader) byte() uint8 { return r.bytes(1)[0] }
+
+func (r *o65Reader) word() uint32 {
+	b := r.bytes(2)
+	return uint32(b[0]) | uint32(b[1])<<8
+}
+
+// addr() reads an address or size field (16 or 32 bits).
+func (r *o65Reader) addr() (val uint32) {
+	val = r.word()
+	if r.long {
+		val |= r.word() << 16
+	}
+	return
+}
+
+func (r *o65Reader) name() string {
+	start := r.pos
+	for r.byte() != 0 && r.err == nil {
+	}
+	if r.err != nil {
+		return ""
+	}
+	return string(r.buf[start : r.pos-1])
+}
+
+// loadO65() loads and relocates an o65 file. The text segment is
+// placed at the base address given by the specification and the
+// other segments follow it unless their base addresses are also
+// given. Exported globals are added to the source as labels.
+func loadO65(spec o65Spec) error {
+
+	fmt.Fprintln(msgOut, "Found o65 file:", spec.path)
+
+	buf, err := os.ReadFile(spec.path)
+	if err != nil {
+		return err
+	}
+	if err = relocO65(buf, spec); err != nil {
+		return fmt.Errorf("%s: %v", spec.path, err)
+	}
+	fmt.Fprintln(msgOut, "o65 file loaded\n")
+	return nil
+}
+
+// relocO65() parses, relocates and loads an o65 file image.
+func relocO65(buf []uint8, spec o65Spec) error {
+	r := &o65Reader{buf: buf}
+	if string(r.bytes(5)) != "\x01\x00o65" {
+		return fmt.Errorf("not an o65 file")
+	}
+	if version := r.byte(); version != 0 {
+		return fmt.Errorf("unsupported o65 version %d", version)
+	}
+	mode := r.word()
+	switch {
+	case mode&o65Mode816 != 0:
+		return fmt.Errorf("65816 code is not supported")
+	case mode&o65ModeChain != 0:
+		return fmt.Errorf("chained o65 files are not supported")
+	}
+	r.long = mode&o65ModeLong != 0
+
+	// header fields and base addresses of segments
+	var base, size, reloc [6]uint32
+	for seg := o65SegText; seg <= o65SegZero; seg++ {
+		base[seg] = r.addr()
+		size[seg] = r.addr()
+	}
+	r.addr() // stack size
+	reloc[o65SegText] = spec.text
+	reloc[o65SegData] = reloc[o65SegText] + size[o65SegText]
+	reloc[o65SegBss] = reloc[o65SegData] + size[o65SegData]
+	reloc[o65SegZero] = base[o65SegZero]
+	if spec.dataSet {
+		reloc[o65SegData] = spec.data
+	}
+	if spec.bssSet {
+		reloc[o65SegBss] = spec.bss
+	}
+	if spec.zeroSet {
+		reloc[o65SegZero] = spec.zero
+	}
+	var delta [6]uint32
+	for seg := o65SegText; seg <= o65SegZero; seg++ {
+		if reloc[seg]+size[seg] > memSize {
+			return fmt.Errorf("segment %d at %X extends beyond %s", seg, reloc[seg], fmtWord(memMax))
+		}
+		delta[seg] = reloc[seg] - base[seg]
+	}
+
+	// header options are skipped
+	for {
+		olen := int(r.byte())
+		if olen == 0 || r.err != nil {
+			break
+		}
+		if olen < 2 {
+			return fmt.Errorf("invalid header option length %d", olen)
+		}
+		r.bytes(olen - 1)
+	}
+
+	text := append([]uint8(nil), r.bytes(int(size[o65SegText]))...)
+	data := append([]uint8(nil), r.bytes(int(size[o65SegData]))...)
+
+	// undefined references cannot be resolved
+	undefs := make([]string, r.addr())
+	for i := range undefs {
+		undefs[i] = r.name()
+	}
+	if len(undefs) > 0 && r.err == nil {
+		return fmt.Errorf("unresolved references: %s", strings.Join(undefs, ", "))
+	}
+
+	for _, seg := range [][]uint8{text, data} {
+		if err := relocSeg(r, seg, mode&o65ModePage != 0, delta); err != nil {
+			return err
+		}
+	}
+
+	// exported globals
+	type global struct {
+		name string
+		seg  uint8
+		val  uint32
+	}
+	globals := make([]global, r.addr())
+	for i := range globals {
+		globals[i].name = r.name()
+		globals[i].seg = r.byte()
+		globals[i].val = r.addr()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	fmt.Fprintln(msgOut, "Relocating text to "+fmtWord(uint16(reloc[o65SegText]))+
+		", data to "+fmtWord(uint16(reloc[o65SegData]))+
+		", bss to "+fmtWord(uint16(reloc[o65SegBss]))+
+		", zero page to "+fmtByte(uint8(reloc[o65SegZero])))
+
+	loadBegin(spec.path)
+	err := loadData(reloc[o65SegText], text)
+	if err == nil {
+		err = loadData(reloc[o65SegData], data)
+	}
+	if err == nil && mode&o65ModeZero != 0 {
+		err = loadData(reloc[o65SegBss], make([]uint8, size[o65SegBss]))
+	}
+	loadEnd()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range globals {
+		if g.seg > o65SegZero {
+			return fmt.Errorf("global %s has invalid segment %d", g.name, g.seg)
+		}
+		addr := uint16(g.val + delta[g.seg])
+		sd := src[addr]
+		sd.label = g.name
+		src[addr] = sd
+		addSym(g.name, addr)
+	}
+	fmt.Fprintln(msgOut, len(globals), "exported globals added as labels")
+	return nil
+}
+
+// relocSeg() applies a relocation table to a segment image. Each
+// entry gives the offset from the previous entry (starting one byte
+// before the segment) followed by the relocation type and segment.
+func relocSeg(r *o65Reader, seg []uint8, pageWise bool, delta [6]uint32) error {
+	pos := -1
+	for r.err == nil {
+		offset := int(r.byte())
+		if offset == 0 {
+			break
+		}
+		if offset == 255 {
+			pos += 254
+			continue
+		}
+		pos += offset
+		typeByte := r.byte()
+		rtype, rseg := typeByte&0xE0, typeByte&0x1F
+		if rseg == o65SegUndef {
+			return fmt.Errorf("relocation uses undefined reference")
+		}
+		if rseg > o65SegZero {
+			return fmt.Errorf("relocation has invalid segment %d", rseg)
+		}
+		d := delta[rseg]
+		if pos < 0 || pos >= len(seg) || rtype == o65RelWord && pos+1 >= len(seg) {
+			return fmt.Errorf("relocation offset %X is outside segment", pos)
+		}
+		switch rtype {
+		case o65RelWord:
+			val := uint32(seg[pos]) | uint32(seg[pos+1])<<8 + d
+			seg[pos], seg[pos+1] = uint8(val), uint8(val>>8)
+		case o65RelHigh:
+			lo := uint32(0)
+			if !pageWise {
+				lo = uint32(r.byte())
+			}
+			val := uint32(seg[pos])<<8 | lo + d
+			seg[pos] = uint8(val >> 8)
+		case o65RelLow:
+			seg[pos] = uint8(uint32(seg[pos]) + d)
+		default:
+			return fmt.Errorf("unsupported relocation type %s", fmtByte(rtype))
+		}
+	}
+	return r.err
+}
+
+// String() formats o65 file specifications for the flag package.
+func (specs *o65Specs) String() string {
+	return fmt.Sprint(*specs)
+}
+
+// Set() parses an o65 file specification for the flag package.
+// The format is path,at=hhhh optionally followed by data=hhhh,
+// bss=hhhh and/or zp=hh to place the other segments.
+func (specs *o65Specs) Set(val string) error {
+	fields := strings.Split(val, ",")
+	spec := o65Spec{path: fields[0]}
+	atSet := false
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key=value: %s", field)
+		}
+		num, err := parseHex(kv[1], 16)
+		if err != nil {
+			return err
+		}
+		switch kv[0] {
+		case "at":
+			spec.text, atSet = uint32(num), true
+		case "data":
+			spec.data, spec.dataSet = uint32(num), true
+		case "bss":
+			spec.bss, spec.bssSet = uint32(num), true
+		case "zp":
+			if num > 0xFF {
+				return fmt.Errorf("zero page address %X is beyond FF", num)
+			}
+			spec.zero, spec.zeroSet = uint32(num), true
+		default:
+			return fmt.Errorf("unknown key: %s", kv[0])
+		}
+	}
+	if !atSet {
+		return fmt.Errorf("at= is required")
+	}
+	*specs = append(*specs, spec)
+	return nil
+}
@@ -344,6 +344,7 @@ func brkImp() {
 	pushByte(sr)
 	setI()
 	pc = readWord(irqVec)
+	callEnter(frameBrk, opPc, opPc+2)
 	ck += 7
 }
 
@@ -722,6 +723,7 @@ func jsrAbs() {
 	pc += 1
 	pushWord(pc + 1)
 	pc = readWord(pc)
+	callEnter(frameJsr, opPc, opPc+3)
 	ck += 6
 }
 
@@ -1060,6 +1062,7 @@ func phpImp() {
 }
 
 func plaImp() {
+	chkPull()
 	ac = popByte()
 	chgZ(ac == 0)
 	chgN(ac > 127)
@@ -1068,6 +1071,7 @@ func plaImp() {
 }
 
 func plpImp() {
+	chkPull()
 	sr = popByte() | maskU | maskB
 	pc += 1
 	ck += 4
@@ -1160,14 +1164,18 @@ func rorAbx() {
 }
 
 func rtiImp() {
+	top := sp
 	sr = popByte() | maskU | maskB
 	pc = popWord()
+	chkReturn(callLeave(top))
 	ck += 6
 }
 
 func rtsImp() {
+	top := sp
 	pc = popWord()
 	pc += 1
+	chkReturn(callLeave(top))
 	ck += 6
 }
 
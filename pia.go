@@ -0,0 +1,332 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+// The 6821 PIA (Peripheral Interface Adapter) has two 8-bit ports, each
+// with a data direction register, a control register and two control
+// lines (CA1/CA2 and CB1/CB2). The registers occupy 4 addresses:
+//
+//	Offset  Register
+//	0       Port A or DDR A (selected by CRA bit 2)
+//	1       Control register A (CRA)
+//	2       Port B or DDR B (selected by CRB bit 2)
+//	3       Control register B (CRB)
+//
+// The control register bits are:
+//
+//	Bit  Function
+//	0    C1 interrupt enable
+//	1    C1 active edge (1 = rising)
+//	2    Port selected (1) or DDR selected (0)
+//	3-5  C2 control: input with bit 3 interrupt enable and bit 4 active
+//	     edge (bit 5 = 0), handshake (100), pulse (101) or output at
+//	     the level of bit 3 (11x)
+//	6    C2 interrupt flag (read only)
+//	7    C1 interrupt flag (read only)
+//
+// Active edges of the control lines set the interrupt flags, which are
+// cleared by reading the port. Enabled flags drive IRQA for port A and
+// IRQB for port B, both of which are wired to IRQ. In handshake mode,
+// CA2 goes low when port A is read and CB2 goes low when port B is
+// written, returning high on the next active edge of CA1 or CB1. In
+// pulse mode they go low for one cycle.
+//
+// With irq=off, IRQA and IRQB are left unconnected, as on machines that
+// poll the interrupt flags instead.
+//
+// The ports (pa and pb) and control lines (ca1, ca2, cb1 and cb2) are
+// available to the host as device pins. Input pins are pulled high
+// until driven by the host.
+
+// PIA register offsets
+const (
+	piaPra = 0x0 // Port A or DDR A
+	piaCra = 0x1 // Control register A
+	piaPrb = 0x2 // Port B or DDR B
+	piaCrb = 0x3 // Control register B
+)
+
+// PIA control register fields
+const (
+	piaC1Irq    = 0x01 // C1 interrupt enable
+	piaC1Pos    = 0x02 // C1 active on rising edge
+	piaPort     = 0x04 // Port selected (otherwise DDR)
+	piaC2Irq    = 0x08 // C2 interrupt enable (input) or level (output)
+	piaC2Pos    = 0x10 // C2 active on rising edge (input) or manual (output)
+	piaC2Out    = 0x20 // C2 is an output
+	piaC2Flag   = 0x40 // C2 interrupt flag
+	piaC1Flag   = 0x80 // C1 interrupt flag
+	piaCtrlBits = 0x3F // Writable control bits
+)
+
+// piaRegs is the state of a PIA.
+// Fields must be exported for gob encoding.
+type piaRegs struct {
+	Ora, Orb   uint8 // Output registers
+	Ddra, Ddrb uint8 // Data direction registers (1 = output)
+	Cra, Crb   uint8 // Control registers (including interrupt flags)
+	PaIn, PbIn uint8 // Port levels driven by the host
+	PaOut      uint8 // Port A levels last reported to the host
+	PbOut      uint8 // Port B levels last reported to the host
+
+	Ca1, Ca2, Cb1, Cb2 bool // Control line levels
+	Ca2Pulse           bool // CA2 pulse output ends on next cycle
+	Cb2Pulse           bool // CB2 pulse output ends on next cycle
+}
+
+// pia is a 6821 PIA device.
+type pia struct {
+	id    string
+	noIrq bool // IRQA and IRQB not connected
+	piaRegs
+}
+
+// newPia() creates a PIA from a device specification.
+func newPia(spec devSpec) (device, error) {
+	if err := spec.check("irq"); err != nil {
+		return nil, err
+	}
+	irq, err := spec.opt("irq", "on", "off")
+	if err != nil {
+		return nil, err
+	}
+	p := &pia{id: spec.name, noIrq: irq == "off"}
+	p.PaIn, p.PbIn, p.PaOut, p.PbOut = 0xFF, 0xFF, 0xFF, 0xFF
+	p.Ca1, p.Ca2, p.Cb1, p.Cb2 = true, true, true, true
+	return p, nil
+}
+
+func (p *pia) name() string { return p.id }
+
+// reset() clears all registers.
+func (p *pia) reset() {
+	p.Ora, p.Orb, p.Ddra, p.Ddrb, p.Cra, p.Crb = 0, 0, 0, 0, 0, 0
+	p.Ca2Pulse, p.Cb2Pulse = false, false
+	p.Ca2, p.Cb2 = p.c2In(p.Ca2, p.Cra), p.c2In(p.Cb2, p.Crb)
+	p.update()
+}
+
+func (p *pia) read(off uint16) (data uint8) {
+	data = p.peek(off)
+	switch off {
+	case piaPra:
+		if p.Cra&piaPort != 0 {
+			p.Cra &^= piaC1Flag | piaC2Flag
+			p.handshake("ca2", &p.Ca2, &p.Ca2Pulse, p.Cra)
+		}
+	case piaPrb:
+		if p.Crb&piaPort != 0 {
+			p.Crb &^= piaC1Flag | piaC2Flag
+		}
+	}
+	p.update()
+	return
+}
+
+func (p *pia) peek(off uint16) (data uint8) {
+	switch off {
+	case piaPra:
+		data = p.Ddra
+		if p.Cra&piaPort != 0 {
+			data = p.portA()
+		}
+	case piaCra:
+		data = p.Cra
+	case piaPrb:
+		data = p.Ddrb
+		if p.Crb&piaPort != 0 {
+			data = p.portB()
+		}
+	case piaCrb:
+		data = p.Crb
+	}
+	return
+}
+
+func (p *pia) write(off uint16, data uint8) {
+	switch off {
+	case piaPra:
+		if p.Cra&piaPort != 0 {
+			p.Ora = data
+		} else {
+			p.Ddra = data
+		}
+	case piaCra:
+		p.Cra = p.Cra&^piaCtrlBits | data&piaCtrlBits
+		p.Ca2 = p.c2In(p.Ca2, p.Cra)
+		p.c2Out("ca2", &p.Ca2, p.Cra)
+	case piaPrb:
+		if p.Crb&piaPort != 0 {
+			p.Orb = data
+			p.handshake("cb2", &p.Cb2, &p.Cb2Pulse, p.Crb)
+		} else {
+			p.Ddrb = data
+		}
+	case piaCrb:
+		p.Crb = p.Crb&^piaCtrlBits | data&piaCtrlBits
+		p.Cb2 = p.c2In(p.Cb2, p.Crb)
+		p.c2Out("cb2", &p.Cb2, p.Crb)
+	}
+	p.update()
+}
+
+// tick() ends any pulse output on CA2 or CB2.
+func (p *pia) tick(cycles uint64) {
+	if cycles == 0 {
+		return
+	}
+	if p.Ca2Pulse {
+		p.Ca2Pulse = false
+		p.setLine("ca2", &p.Ca2, true)
+	}
+	if p.Cb2Pulse {
+		p.Cb2Pulse = false
+		p.setLine("cb2", &p.Cb2, true)
+	}
+}
+
+// portA() returns the levels of the port A pins.
+func (p *pia) portA() uint8 {
+	return p.Ora&p.Ddra | p.PaIn&^p.Ddra
+}
+
+// portB() returns the levels of the port B pins.
+func (p *pia) portB() uint8 {
+	return p.Orb&p.Ddrb | p.PbIn&^p.Ddrb
+}
+
+// c2In() returns the level of CA2 or CB2 when it becomes an input.
+func (p *pia) c2In(level bool, cr uint8) bool {
+	if cr&piaC2Out == 0 {
+		return true
+	}
+	return level
+}
+
+// c2Out() drives CA2 or CB2 for the manual output modes.
+func (p *pia) c2Out(pin string, line *bool, cr uint8) {
+	if cr&(piaC2Out|piaC2Pos) == piaC2Out|piaC2Pos {
+		p.setLine(pin, line, cr&piaC2Irq != 0)
+	}
+}
+
+// handshake() drives CA2 or CB2 low on a port access in the handshake
+// and pulse output modes.
+func (p *pia) handshake(pin string, line *bool, pulse *bool, cr uint8) {
+	if cr&(piaC2Out|piaC2Pos) == piaC2Out {
+		*pulse = cr&piaC2Irq != 0
+		p.setLine(pin, line, false)
+	}
+}
+
+// setLine() drives a control line, reporting changes to the host.
+func (p *pia) setLine(pin string, line *bool, level bool) {
+	if *line != level {
+		*line = level
+		pinOut(p, pin, pinLevel(level))
+	}
+}
+
+// irq() returns the level of IRQA or IRQB (true when active)
+// for a control register.
+func (p *pia) irq(cr uint8) bool {
+	return cr&piaC1Flag != 0 && cr&piaC1Irq != 0 ||
+		cr&piaC2Flag != 0 && cr&piaC2Irq != 0 && cr&piaC2Out == 0
+}
+
+// update() drives IRQ from IRQA and IRQB and reports any change of the
+// port outputs to the host.
+func (p *pia) update() {
+	setIrq(p, !p.noIrq && (p.irq(p.Cra) || p.irq(p.Crb)))
+	if a := p.portA(); a != p.PaOut {
+		p.PaOut = a
+		pinOut(p, "pa", a)
+	}
+	if b := p.portB(); b != p.PbOut {
+		p.PbOut = b
+		pinOut(p, "pb", b)
+	}
+}
+
+func (p *pia) pins() []string {
+	return []string{"pa", "pb", "ca1", "ca2", "cb1", "cb2"}
+}
+
+func (p *pia) pin(name string) uint8 {
+	switch name {
+	case "pa":
+		return p.portA()
+	case "pb":
+		return p.portB()
+	case "ca1":
+		return pinLevel(p.Ca1)
+	case "ca2":
+		return pinLevel(p.Ca2)
+	case "cb1":
+		return pinLevel(p.Cb1)
+	case "cb2":
+		return pinLevel(p.Cb2)
+	}
+	return 0
+}
+
+// setPin() drives the PIA inputs. Active edges of the control lines set
+// interrupt flags and complete handshakes.
+func (p *pia) setPin(name string, level uint8) {
+	high := level != 0
+	switch name {
+	case "pa":
+		p.PaIn = level
+	case "pb":
+		p.PbIn = level
+	case "ca1":
+		p.c1Edge("ca2", &p.Ca1, &p.Ca2, &p.Cra, high)
+	case "ca2":
+		p.c2Edge(&p.Ca2, &p.Cra, high)
+	case "cb1":
+		p.c1Edge("cb2", &p.Cb1, &p.Cb2, &p.Crb, high)
+	case "cb2":
+		p.c2Edge(&p.Cb2, &p.Crb, high)
+	}
+	p.update()
+}
+
+// c1Edge() drives CA1 or CB1, setting the C1 interrupt flag on an active
+// edge and returning CA2 or CB2 high in handshake mode.
+func (p *pia) c1Edge(pin2 string, line, line2 *bool, cr *uint8, high bool) {
+	if high == *line {
+		return
+	}
+	*line = high
+	if high == (*cr&piaC1Pos != 0) {
+		*cr |= piaC1Flag
+		if *cr&(piaC2Out|piaC2Pos|piaC2Irq) == piaC2Out {
+			p.setLine(pin2, line2, true)
+		}
+	}
+}
+
+// c2Edge() drives CA2 or CB2 as an input, setting the C2 interrupt flag
+// on an active edge.
+func (p *pia) c2Edge(line *bool, cr *uint8, high bool) {
+	if *cr&piaC2Out != 0 || high == *line {
+		return
+	}
+	*line = high
+	if high == (*cr&piaC2Pos != 0) {
+		*cr |= piaC2Flag
+	}
+}
+
+func (p *pia) state() []byte {
+	return encodeState(&p.piaRegs)
+}
+
+func (p *pia) setState(state []byte) error {
+	p.piaRegs = piaRegs{}
+	if err := decodeState(state, &p.piaRegs); err != nil {
+		return err
+	}
+	p.update()
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The 6532 RIOT (RAM-I/O-Timer) has 128 bytes of RAM, two 8-bit ports
+// with data direction registers, an interval timer and interrupts from
+// the timer and from edges on PA7. The I/O and timer registers occupy
+// 32 addresses, decoded from address lines A0-A4:
+//
+//	A4 A3 A2 A1 A0  Read                     Write
+//	 x  x  0  0  0  Port A                   Port A
+//	 x  x  0  0  1  DDR A                    DDR A
+//	 x  x  0  1  0  Port B                   Port B
+//	 x  x  0  1  1  DDR B                    DDR B
+//	 x  e  1  x  0  Timer (e enables irq)    -
+//	 x  x  1  x  1  Interrupt flags          -
+//	 0  x  1  i  p  -                        PA7 edge (p positive, i irq)
+//	 1  e  1  s  s  -                        Timer (ss prescale, e irq)
+//
+// The RAM is selected separately (by RS on the chip) and may be placed
+// anywhere with the ram= option. The timer is written with a count and
+// a prescale of 1, 8, 64 or 1024 cycles. It decrements one cycle after
+// it is written and then once per prescale period. When it decrements
+// past zero, the timer flag is set and it decrements every cycle until
+// written again, so that the time since expiry can be read. Reading or
+// writing the timer clears the timer flag. Reading the interrupt flags
+// (bit 7 timer, bit 6 PA7) clears the PA7 flag.
+//
+// The ports (pa and pb) are available to the host as device pins.
+// Input pins are pulled high until driven by the host.
+//
+// The 6530 RRIOT (ROM-RAM-I/O-Timer) used in the KIM-1 is the same apart
+// from having 1K of mask-programmed ROM, 64 bytes of RAM, no PA7 edge
+// detector and only 16 register addresses (A0-A3), where any write with
+// A2 set writes the timer. The ROM is placed with the rom= option and
+// its contents are read from the file given by image=, from offset off=
+// (default 0) in the file.
+
+// RIOT parameters
+const (
+	riotRamSize  = 0x80
+	riotIoSize   = 0x20
+	rriotRamSize = 0x40
+	rriotRomSize = 0x400
+	rriotIoSize  = 0x10
+)
+
+// RIOT interrupt flags
+const (
+	riotIrqPa7   = 0x40
+	riotIrqTimer = 0x80
+)
+
+// riotPrescales gives the timer prescale for each prescale select value.
+var riotPrescales = [4]int{1, 8, 64, 1024}
+
+// riotRegs is the state of a RIOT.
+// Fields must be exported for gob encoding.
+type riotRegs struct {
+	Ram        [riotRamSize]uint8
+	Ora, Orb   uint8 // Output registers
+	Ddra, Ddrb uint8 // Data direction registers (1 = output)
+	PaIn, PbIn uint8 // Port levels driven by the host
+	PaOut      uint8 // Port A levels last reported to the host
+	PbOut      uint8 // Port B levels last reported to the host
+
+	Timer    uint8 // Timer count
+	Prescale int   // Timer prescale (1 after expiry)
+	Div      int   // Cycles to next timer decrement
+	TimerIrq bool  // Timer interrupt enabled
+	Pa7Irq   bool  // PA7 interrupt enabled
+	Pa7Pos   bool  // PA7 positive edge detected (otherwise negative)
+	Flags    uint8 // Interrupt flags
+}
+
+// riot is a 6532 RIOT or 6530 RRIOT device.
+type riot struct {
+	id    string
+	rriot bool    // 6530 RRIOT
+	rom   []uint8 // RRIOT ROM contents
+	riotRegs
+}
+
+// riotRam is the RAM of a RIOT, registered as a separate device.
+type riotRam struct {
+	r *riot
+}
+
+// riotRom is the ROM of an RRIOT, registered as a separate device.
+type riotRom struct {
+	r *riot
+}
+
+// newRiot() creates a RIOT from a device specification. If the
+// ram= option is given, the RAM is also registered at that address.
+func newRiot(spec devSpec) (device, error) {
+	if err := spec.check("ram"); err != nil {
+		return nil, err
+	}
+	r := &riot{id: spec.name}
+	r.PaIn, r.PbIn, r.PaOut, r.PbOut = 0xFF, 0xFF, 0xFF, 0xFF
+	r.Prescale, r.Div = 1024, 1024
+	if err := r.addMem(spec, "ram", &riotRam{r}, riotRamSize); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newRriot() creates an RRIOT from a device specification. If the ram=
+// or rom= options are given, the RAM or ROM is also registered at that
+// address.
+func newRriot(spec devSpec) (device, error) {
+	if err := spec.check("ram", "rom", "image", "off"); err != nil {
+		return nil, err
+	}
+	r := &riot{id: spec.name, rriot: true, rom: make([]uint8, rriotRomSize)}
+	r.PaIn, r.PbIn, r.PaOut, r.PbOut = 0xFF, 0xFF, 0xFF, 0xFF
+	r.Prescale, r.Div = 1024, 1024
+	for i := range r.rom {
+		r.rom[i] = 0xFF
+	}
+	if path, ok := spec.opts["image"]; ok {
+		off := uint64(0)
+		if val, ok := spec.opts["off"]; ok {
+			var err error
+			if off, err = parseHex(val, 32); err != nil {
+				return nil, fmt.Errorf("%s: invalid off=%s", spec.name, val)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if off+rriotRomSize > uint64(len(data)) {
+			return nil, fmt.Errorf("%s: %s has no ROM image at offset %X", spec.name, path, off)
+		}
+		copy(r.rom, data[off:])
+	}
+	if err := r.addMem(spec, "ram", &riotRam{r}, rriotRamSize); err != nil {
+		return nil, err
+	}
+	if err := r.addMem(spec, "rom", &riotRom{r}, rriotRomSize); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// addMem() registers the RAM or ROM at the address given by an option
+// (if any).
+func (r *riot) addMem(spec devSpec, key string, dev device, size uint64) error {
+	val, ok := spec.opts[key]
+	if !ok {
+		return nil
+	}
+	addr, err := parseHex(val, 16)
+	if err != nil || addr+size-1 > uint64(memMax) {
+		return fmt.Errorf("%s: invalid %s=%s", spec.name, key, val)
+	}
+	if err = addDev(dev, uint16(addr), uint16(addr+size-1)); err != nil {
+		return err
+	}
+	fmt.Fprintln(msgOut, "Device", dev.name(), "at", fmtWord(uint16(addr))+"-"+fmtWord(uint16(addr+size-1)))
+	return nil
+}
+
+func (r *riot) name() string { return r.id }
+
+// reset() clears the port registers and disables interrupts.
+// The RAM and timer are not affected.
+func (r *riot) reset() {
+	r.Ora, r.Orb, r.Ddra, r.Ddrb = 0, 0, 0, 0
+	r.TimerIrq, r.Pa7Irq, r.Pa7Pos = false, false, false
+	r.update()
+}
+
+func (r *riot) read(off uint16) (data uint8) {
+	data = r.peek(off)
+	if off&0x04 != 0 {
+		if off&0x01 == 0 {
+			r.TimerIrq = off&0x08 != 0
+			r.Flags &^= riotIrqTimer
+		} else {
+			r.Flags &^= riotIrqPa7
+		}
+		r.update()
+	}
+	return
+}
+
+func (r *riot) peek(off uint16) (data uint8) {
+	switch {
+	case off&0x04 == 0:
+		switch off & 0x03 {
+		case 0:
+			data = r.portA()
+		case 1:
+			data = r.Ddra
+		case 2:
+			data = r.Orb&r.Ddrb | r.PbIn&^r.Ddrb
+		case 3:
+			data = r.Ddrb
+		}
+	case off&0x01 == 0:
+		data = r.Timer
+	default:
+		data = r.Flags
+	}
+	return
+}
+
+func (r *riot) write(off uint16, data uint8) {
+	switch {
+	case off&0x04 == 0:
+		switch off & 0x03 {
+		case 0:
+			r.Ora = data
+		case 1:
+			r.Ddra = data
+		case 2:
+			r.Orb = data
+		case 3:
+			r.Ddrb = data
+		}
+	case off&0x10 != 0 || r.rriot:
+		r.Timer = data
+		r.Prescale = riotPrescales[off&0x03]
+		r.Div = 1
+		r.TimerIrq = off&0x08 != 0
+		r.Flags &^= riotIrqTimer
+	default:
+		r.Pa7Pos = off&0x01 != 0
+		r.Pa7Irq = off&0x02 != 0
+	}
+	r.update()
+}
+
+// tick() advances the timer.
+func (r *riot) tick(cycles uint64) {
+	for ; cycles > 0; cycles-- {
+		if r.Div--; r.Div > 0 {
+			continue
+		}
+		if r.Timer--; r.Timer == 0xFF {
+			r.Flags |= riotIrqTimer
+			r.Prescale = 1
+		}
+		r.Div = r.Prescale
+	}
+	r.update()
+}
+
+// portA() returns the levels of the port A pins.
+func (r *riot) portA() uint8 {
+	return r.Ora&r.Ddra | r.PaIn&^r.Ddra
+}
+
+// portB() returns the levels of the port B pins.
+func (r *riot) portB() uint8 {
+	return r.Orb&r.Ddrb | r.PbIn&^r.Ddrb
+}
+
+// update() drives IRQ from the interrupt flags and reports any change
+// of the port outputs to the host. Edges on PA7 are detected whether
+// they are driven by the host or by the RIOT itself.
+func (r *riot) update() {
+	a := r.portA()
+	if edge := (a ^ r.PaOut) & 0x80; edge != 0 && (a&0x80 != 0) == r.Pa7Pos && !r.rriot {
+		r.Flags |= riotIrqPa7
+	}
+	setIrq(r, r.Flags&riotIrqTimer != 0 && r.TimerIrq || r.Flags&riotIrqPa7 != 0 && r.Pa7Irq)
+	if a != r.PaOut {
+		r.PaOut = a
+		pinOut(r, "pa", a)
+	}
+	if b := r.portB(); b != r.PbOut {
+		r.PbOut = b
+		pinOut(r, "pb", b)
+	}
+}
+
+func (r *riot) pins() []string {
+	return []string{"pa", "pb"}
+}
+
+func (r *riot) pin(name string) uint8 {
+	if name == "pa" {
+		return r.portA()
+	}
+	return r.portB()
+}
+
+func (r *riot) setPin(name string, level uint8) {
+	if name == "pa" {
+		r.PaIn = level
+	} else {
+		r.PbIn = level
+	}
+	r.update()
+}
+
+func (r *riot) state() []byte {
+	return encodeState(&r.riotRegs)
+}
+
+func (r *riot) setState(state []byte) error {
+	r.riotRegs = riotRegs{}
+	if err := decodeState(state, &r.riotRegs); err != nil {
+		return err
+	}
+	r.update()
+	return nil
+}
+
+func (m *riotRam) name() string                 { return m.r.id + "-ram" }
+func (m *riotRam) read(off uint16) uint8        { return m.r.Ram[off] }
+func (m *riotRam) peek(off uint16) uint8        { return m.r.Ram[off] }
+func (m *riotRam) write(off uint16, data uint8) { m.r.Ram[off] = data }
+func (m *riotRam) reset()                       {}
+func (m *riotRam) tick(cycles uint64)           {}
+
+func (m *riotRom) name() string                 { return m.r.id + "-rom" }
+func (m *riotRom) read(off uint16) uint8        { return m.r.rom[off] }
+func (m *riotRom) peek(off uint16) uint8        { return m.r.rom[off] }
+func (m *riotRom) write(off uint16, data uint8) {}
+func (m *riotRom) reset()                       {}
+func (m *riotRom) tick(cycles uint64)           {}
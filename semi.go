@@ -0,0 +1,190 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The semihosting device gives test programs direct access to host
+// services, so that they can report results precisely instead of
+// spinning in an endless loop for the emulator to detect. Arguments are
+// written to the argument registers and the service is then performed
+// by writing its number to the command register. The status register
+// is 00 if the service succeeded or FF if it failed.
+//
+//	Offset  Register
+//	0       Command (write only)
+//	1       Status
+//	2       Argument byte
+//	4-5     Address
+//	6-7     Destination
+//	8-9     Length
+//	A-F     Cycle clock (48 bits)
+//
+// Multi-byte registers are little-endian. The services are:
+//
+//	01  Exit      Terminate the emulator with the argument byte as the
+//	              exit code
+//	02  Putc      Print the argument byte as a character
+//	03  Puts      Print the zero-terminated string at the address
+//	04  Putd      Print the number at the address in decimal, of length
+//	              1 to 4 bytes
+//	05  Puth      Print the number at the address in hex, of length
+//	              1 to 4 bytes
+//	06  Load      Read the host file named by the zero-terminated string
+//	              at the address into memory at the destination, up to
+//	              the length in bytes (0 for no limit). The length is set
+//	              to the number of bytes read.
+//	07  Cycles    Capture the cycle clock in the cycle clock registers
+
+// Semihosting register offsets
+const (
+	semiCmd    = 0x0
+	semiStatus = 0x1
+	semiArg    = 0x2
+	semiAddr   = 0x4
+	semiDest   = 0x6
+	semiLen    = 0x8
+	semiCk     = 0xA
+)
+
+// Semihosting services
+const (
+	semiExit   = 0x01
+	semiPutc   = 0x02
+	semiPuts   = 0x03
+	semiPutd   = 0x04
+	semiPuth   = 0x05
+	semiLoad   = 0x06
+	semiCycles = 0x07
+)
+
+// semiRegs is the state of a semihosting device.
+// Fields must be exported for gob encoding.
+type semiRegs struct {
+	Regs [0x10]uint8
+}
+
+// semi is a semihosting device.
+type semi struct {
+	id string
+	semiRegs
+}
+
+// newSemi() creates a semihosting device from a device specification.
+func newSemi(spec devSpec) (device, error) {
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+	return &semi{id: spec.name}, nil
+}
+
+func (s *semi) name() string { return s.id }
+
+func (s *semi) reset() {
+	s.semiRegs = semiRegs{}
+}
+
+func (s *semi) read(off uint16) uint8 { return s.peek(off) }
+
+func (s *semi) peek(off uint16) uint8 {
+	if off == semiCmd {
+		return 0
+	}
+	return s.Regs[off]
+}
+
+func (s *semi) write(off uint16, data uint8) {
+	if off != semiCmd {
+		s.Regs[off] = data
+		return
+	}
+	ok := true
+	switch data {
+	case semiExit:
+		requestExit(int(s.Regs[semiArg]))
+	case semiPutc:
+		os.Stdout.Write([]uint8{s.Regs[semiArg]})
+	case semiPuts:
+		os.Stdout.Write(s.str())
+	case semiPutd, semiPuth:
+		var num uint32
+		var n uint16
+		if n = s.word(semiLen); n < 1 || n > 4 {
+			ok = false
+			break
+		}
+		for i := n; i > 0; i-- {
+			num = num<<8 | uint32(readByte(s.word(semiAddr)+i-1))
+		}
+		if data == semiPutd {
+			fmt.Print(num)
+		} else {
+			fmt.Printf("%0*X", 2*n, num)
+		}
+	case semiLoad:
+		ok = s.load()
+	case semiCycles:
+		for i := 0; i < 6; i++ {
+			s.Regs[semiCk+i] = uint8(ck >> uint(8*i))
+		}
+	default:
+		ok = false
+	}
+	s.Regs[semiStatus] = 0
+	if !ok {
+		s.Regs[semiStatus] = 0xFF
+	}
+}
+
+// load() reads a host file into memory.
+func (s *semi) load() bool {
+	data, err := os.ReadFile(string(s.str()))
+	if err != nil {
+		return false
+	}
+	dest := uint32(s.word(semiDest))
+	if room := memSize - dest; uint32(len(data)) > room {
+		data = data[:room]
+	}
+	if limit := s.word(semiLen); limit > 0 && len(data) > int(limit) {
+		data = data[:limit]
+	}
+	for i, b := range data {
+		writeByte(uint16(dest)+uint16(i), b)
+	}
+	s.Regs[semiLen] = uint8(len(data))
+	s.Regs[semiLen+1] = uint8(len(data) >> 8)
+	return true
+}
+
+// str() returns the zero-terminated string at the address.
+func (s *semi) str() (b []uint8) {
+	addr := s.word(semiAddr)
+	for i := uint32(0); i < memSize; i++ {
+		c := readByte(addr + uint16(i))
+		if c == 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return
+}
+
+// word() returns a 16-bit register.
+func (s *semi) word(off uint16) uint16 {
+	return uint16(s.Regs[off]) | uint16(s.Regs[off+1])<<8
+}
+
+func (s *semi) tick(cycles uint64) {}
+
+func (s *semi) state() []byte {
+	return encodeState(&s.semiRegs)
+}
+
+func (s *semi) setState(state []byte) error {
+	s.semiRegs = semiRegs{}
+	return decodeState(state, &s.semiRegs)
+}
@@ -0,0 +1,292 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Programs built by cc65 for the sim6502 target are run by the sim65
+// simulator, whose binary format consists of a header followed by the
+// program image:
+//
+//	Offset  Size  Field
+//	0       5     "sim65"
+//	5       1     Format version (2)
+//	6       1     CPU type (0 = 6502, 1 = 65C02)
+//	7       1     Zero page address of the cc65 C stack pointer
+//	8       2     Load address
+//	10      2     Start address
+//
+// Such programs expect RAM throughout memory and call the host through
+// paravirtualization hooks at FFF4-FFF9, where each hook is reached by
+// JSR and returns as if by RTS. Arguments follow the cc65 calling
+// convention: the last argument is in A/X and the others on the C stack.
+// Results are returned in A/X, with FFFF for failure.
+//
+//	FFF4  open(name, flags, ...)  Open a host file
+//	FFF5  close(fd)               Close a host file
+//	FFF6  read(fd, buf, count)    Read from a host file
+//	FFF7  write(fd, buf, count)   Write to a host file
+//	FFF8  args(&argv)             Set argv and return argc
+//	FFF9  exit(code)              Terminate with the exit code in A
+//
+// File descriptors 0, 1 and 2 are the console input, output and error
+// output of the emulator. The arguments are the program path followed by
+// any further command line arguments.
+
+// sim65 binary format parameters
+const (
+	sim65Magic   = "sim65"
+	sim65Version = 2
+	sim65HdrLen  = 12
+	sim65Hooks   = 0xFFF4 // First paravirtualization hook
+)
+
+// sim65Calls are the paravirtualization hooks in address order.
+var sim65Calls = []func(){sim65Open, sim65Close, sim65Read, sim65Write, sim65Args, sim65Exit}
+
+// isSim65() checks for a sim65 binary file.
+func isSim65(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]uint8, len(sim65Magic))
+	n, _ := file.Read(magic)
+	return n == len(magic) && bytes.Equal(magic, []uint8(sim65Magic))
+}
+
+// loadSim65() loads a sim65 binary file. All memory becomes RAM and the
+// start address from the header is used unless -entry is given.
+func loadSim65(path string) error {
+
+	fmt.Fprintln(msgOut, "Found sim65 file:", path)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(buf) < sim65HdrLen:
+		return fmt.Errorf("%s: sim65 header is incomplete", path)
+	case buf[5] != sim65Version:
+		return fmt.Errorf("%s: unsupported sim65 version %d", path, buf[5])
+	case buf[6] != 0:
+		return fmt.Errorf("%s: unsupported CPU type %d (6502 only)", path, buf[6])
+	}
+	sim65Sp = buf[7]
+	addr := uint32(buf[8]) | uint32(buf[9])<<8
+	start := uint16(buf[10]) | uint16(buf[11])<<8
+	buf = buf[sim65HdrLen:]
+	if addr+uint32(len(buf)) > uint32(sim65Hooks) {
+		return fmt.Errorf("%s: program does not fit below %s", path, fmtWord(sim65Hooks))
+	}
+	fmt.Fprintln(msgOut, "Loading program from "+fmtWord(uint16(addr))+" to "+fmtWord(uint16(addr+uint32(len(buf))-1))+"...")
+
+	loadBegin(path)
+	if err = loadData(addr, buf); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	loadEnd()
+
+	fmt.Fprintln(msgOut, "Start address:", fmtWord(start))
+	fmt.Fprintln(msgOut, "C stack pointer at:", fmtByte(sim65Sp))
+	if !entrySet {
+		entryPc, entrySet = start, true
+	}
+	sim65Mode, romRam = true, true
+	sim65Files = map[int]*os.File{1: os.Stdout, 2: os.Stderr}
+	fmt.Fprintln(msgOut, "sim65 file loaded\n")
+	return nil
+}
+
+// sim65Hook() checks for a paravirtualization hook at an address.
+func sim65Hook(addr uint16) bool {
+	return sim65Mode && addr >= sim65Hooks && int(addr-sim65Hooks) < len(sim65Calls)
+}
+
+// sim65Call() performs the paravirtualization hook at the current
+// address in place of an instruction and then returns as if by RTS.
+func sim65Call() {
+	sim65Calls[pc-sim65Hooks]()
+	rtsImp()
+}
+
+// sim65Pop() pops a parameter word from the C stack, adjusting the
+// C stack pointer by the given number of bytes.
+func sim65Pop(incr uint16) uint16 {
+	csp := sim65GetSp()
+	val := readWord(csp)
+	sim65SetSp(csp + incr)
+	return val
+}
+
+// sim65GetSp() returns the C stack pointer.
+func sim65GetSp() uint16 {
+	return uint16(readByte(uint16(sim65Sp))) | uint16(readByte(uint16(sim65Sp)+1))<<8
+}
+
+// sim65SetSp() sets the C stack pointer.
+func sim65SetSp(csp uint16) {
+	writeByte(uint16(sim65Sp), uint8(csp))
+	writeByte(uint16(sim65Sp)+1, uint8(csp>>8))
+}
+
+// sim65Ax() returns the 16-bit value in A/X.
+func sim65Ax() uint16 {
+	return uint16(ix)<<8 | uint16(ac)
+}
+
+// sim65SetAx() returns a 16-bit result in A/X.
+func sim65SetAx(val int) {
+	ac, ix = uint8(val), uint8(val>>8)
+}
+
+// sim65Str() returns the zero-terminated string at an address.
+func sim65Str(addr uint16) string {
+	var b []uint8
+	for i := uint32(0); i < memSize; i++ {
+		c := readByte(addr + uint16(i))
+		if c == 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+func sim65Open() {
+	// Y gives the number of parameter bytes. The mode is optional.
+	sim65Pop(uint16(iy) - 4)
+	flags := sim65Pop(2)
+	name := sim65Str(sim65Pop(2))
+	var oflag int
+	switch flags & 0x03 {
+	case 0x01:
+		oflag = os.O_RDONLY
+	case 0x02:
+		oflag = os.O_WRONLY
+	case 0x03:
+		oflag = os.O_RDWR
+	}
+	if flags&0x10 != 0 {
+		oflag |= os.O_CREATE
+	}
+	if flags&0x20 != 0 {
+		oflag |= os.O_TRUNC
+	}
+	if flags&0x40 != 0 {
+		oflag |= os.O_APPEND
+	}
+	if flags&0x80 != 0 {
+		oflag |= os.O_EXCL
+	}
+	file, err := os.OpenFile(name, oflag, 0666)
+	if err != nil {
+		sim65SetAx(-1)
+		return
+	}
+	fd := 3
+	for sim65Files[fd] != nil {
+		fd++
+	}
+	sim65Files[fd] = file
+	sim65SetAx(fd)
+}
+
+func sim65Close() {
+	fd := int(sim65Ax())
+	file, ok := sim65Files[fd]
+	if !ok && fd != 0 {
+		sim65SetAx(-1)
+		return
+	}
+	if fd > 2 {
+		delete(sim65Files, fd)
+		file.Close()
+	}
+	sim65SetAx(0)
+}
+
+func sim65Read() {
+	count := int(sim65Ax())
+	buf := sim65Pop(2)
+	fd := int(sim65Pop(2))
+	data := make([]uint8, count)
+	var n int
+	var err error
+	switch file, ok := sim65Files[fd]; {
+	case fd == 0:
+		n, err = stdin.Read(data)
+	case ok:
+		n, err = file.Read(data)
+	default:
+		sim65SetAx(-1)
+		return
+	}
+	if err != nil && err != io.EOF {
+		sim65SetAx(-1)
+		return
+	}
+	for i, b := range data[:n] {
+		writeByte(buf+uint16(i), b)
+	}
+	sim65SetAx(n)
+}
+
+func sim65Write() {
+	count := sim65Ax()
+	buf := sim65Pop(2)
+	fd := int(sim65Pop(2))
+	file, ok := sim65Files[fd]
+	if !ok {
+		sim65SetAx(-1)
+		return
+	}
+	data := make([]uint8, count)
+	for i := range data {
+		data[i] = readByte(buf + uint16(i))
+	}
+	n, err := file.Write(data)
+	if err != nil {
+		sim65SetAx(-1)
+		return
+	}
+	sim65SetAx(n)
+}
+
+// sim65Args() copies the arguments to the top of the C stack, below a
+// null-terminated argv array, and stores the address of the array at
+// the address in A/X.
+func sim65Args() {
+	args := append([]string{progPath}, progArgs...)
+	argv := sim65Ax()
+	csp := sim65GetSp()
+	ptr := csp - uint16(len(args)+1)*2
+	writeWord(argv, ptr)
+	csp = ptr
+	for _, arg := range args {
+		csp -= uint16(len(arg) + 1)
+		for i := 0; i <= len(arg); i++ {
+			c := uint8(0)
+			if i < len(arg) {
+				c = arg[i]
+			}
+			writeByte(csp+uint16(i), c)
+		}
+		writeWord(ptr, csp)
+		ptr += 2
+	}
+	writeWord(ptr, 0)
+	sim65SetSp(csp)
+	sim65SetAx(len(args))
+}
+
+func sim65Exit() {
+	requestExit(int(ac))
+}
@@ -0,0 +1,200 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A snapshot file consists of the snapMagic identifier and a 16-bit
+// big-endian format version, followed by the gob encoded snapshot.
+// Snapshots are independent of the source listing, which is reloaded
+// from the LST file as usual. Snapshots from older versions of the
+// format are migrated to the current version when restored. Newer
+// or unknown versions are rejected.
+
+// snapshot contains the complete state of the emulated machine.
+// Fields must be exported for gob encoding.
+type snapshot struct {
+	Name  string    // Name of loaded program
+	Saved time.Time // Time snapshot was taken
+
+	Ck uint64
+	Op uint8
+	Pc uint16
+	Ac uint8
+	Ix uint8
+	Iy uint8
+	Sp uint8
+	Sr uint8
+
+	RamTop   uint16 // Last RAM address (version 3)
+	RomBase  uint16 // First ROM address (version 3)
+	Ram      []uint8
+	Rom      []uint8
+	RamInit  []bool
+	CodeMap  []uint8
+	BinStart uint16
+	Calls    []snapFrame
+
+	BrkCK uint64
+	BrkPC uint16
+	Brks  []uint16 // User breakpoints (version 2)
+
+	SyncRefCk  uint64
+	SyncNextCk uint64
+	SyncCount  uint64
+
+	Devs map[string][]byte // Device state keyed by device name
+}
+
+// snapFrame is a shadow call stack frame in a snapshot.
+type snapFrame struct {
+	Kind   int
+	Site   uint16
+	Target uint16
+	Ret    uint16
+	Sp     uint8
+}
+
+// takeSnap() captures the current machine state.
+func takeSnap() (ss *snapshot) {
+	ss = &snapshot{
+		Name:       progName,
+		Saved:      time.Now(),
+		Ck:         ck,
+		Op:         op,
+		Pc:         pc,
+		Ac:         ac,
+		Ix:         ix,
+		Iy:         iy,
+		Sp:         sp,
+		Sr:         sr,
+		RamTop:     ramTop,
+		RomBase:    romBase,
+		Ram:        append([]uint8(nil), ram...),
+		Rom:        append([]uint8(nil), rom...),
+		RamInit:    append([]bool(nil), ramInit...),
+		CodeMap:    append([]uint8(nil), codeMap...),
+		BinStart:   binStart,
+		BrkCK:      brkCK,
+		BrkPC:      brkPC,
+		SyncRefCk:  syncRefCk,
+		SyncNextCk: syncNextCk,
+		SyncCount:  syncCount,
+		Devs:       make(map[string][]byte),
+	}
+	for _, f := range calls {
+		ss.Calls = append(ss.Calls, snapFrame{f.kind, f.site, f.target, f.ret, f.sp})
+	}
+	for addr := range brks {
+		ss.Brks = append(ss.Brks, addr)
+	}
+	saveDevs(ss)
+	return
+}
+
+// putSnap() replaces the current machine state with a snapshot.
+// The snapshot must match the current memory map.
+func putSnap(ss *snapshot) error {
+	if len(ss.Ram) != len(ram) || len(ss.Rom) != len(rom) ||
+		len(ss.RamInit) != len(ramInit) || len(ss.CodeMap) != len(codeMap) ||
+		ss.RamTop != ramTop || ss.RomBase != romBase {
+		return fmt.Errorf("snapshot memory map does not match emulator")
+	}
+	ck, op, pc, ac, ix, iy, sp, sr = ss.Ck, ss.Op, ss.Pc, ss.Ac, ss.Ix, ss.Iy, ss.Sp, ss.Sr
+	copy(ram, ss.Ram)
+	copy(rom, ss.Rom)
+	copy(ramInit, ss.RamInit)
+	copy(codeMap, ss.CodeMap)
+	binStart = ss.BinStart
+	calls = calls[:0]
+	for _, f := range ss.Calls {
+		calls = append(calls, callFrame{f.Kind, f.Site, f.Target, f.Ret, f.Sp})
+	}
+	brkCK = ss.BrkCK
+	brkPC = ss.BrkPC
+	brks = make(map[uint16]bool)
+	for _, addr := range ss.Brks {
+		brks[addr] = true
+	}
+	if brkPC == pc {
+		// the endless loop check was already made when the
+		// snapshot was taken and must not be repeated
+		brkPC = ^pc
+	}
+	// The real time reference is rebased on the current
+	// time, as if no time had elapsed since the snapshot.
+	syncRefCk = ss.SyncRefCk
+	syncRefReal = time.Now().Add(-time.Duration((ck - syncRefCk) * cpuTick))
+	syncNextCk = ss.SyncNextCk
+	syncCount = ss.SyncCount
+	return restoreDevs(ss)
+}
+
+// saveSnap() saves the current machine state to a snapshot file.
+func saveSnap(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hdr := make([]byte, len(snapMagic)+2)
+	copy(hdr, snapMagic)
+	binary.BigEndian.PutUint16(hdr[len(snapMagic):], snapVersion)
+	if _, err = file.Write(hdr); err != nil {
+		return err
+	}
+	return gob.NewEncoder(file).Encode(takeSnap())
+}
+
+// loadSnap() reads a snapshot file, migrating it to the current
+// format version if necessary.
+func loadSnap(path string) (ss *snapshot, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hdr := make([]byte, len(snapMagic)+2)
+	_, err = io.ReadFull(file, hdr)
+	if err != nil || string(hdr[:len(snapMagic)]) != snapMagic {
+		return nil, fmt.Errorf("%s: not an em65 snapshot file", path)
+	}
+	version := int(binary.BigEndian.Uint16(hdr[len(snapMagic):]))
+	switch {
+	case version >= 1 && version <= snapVersion:
+		// Fields added since version 1 are decoded as
+		// empty values, which is a valid migration for
+		// every version so far apart from the memory map:
+		// version 2 added user breakpoints (none in version 1),
+		// version 3 the memory map (the default map before).
+		ss = new(snapshot)
+		if err = gob.NewDecoder(file).Decode(ss); err != nil {
+			return nil, fmt.Errorf("%s: corrupt snapshot: %v", path, err)
+		}
+		if version < 3 {
+			ss.RamTop, ss.RomBase = ramMax, romMin
+		}
+	case version > snapVersion:
+		err = fmt.Errorf("%s: snapshot version %d is newer than supported version %d",
+			path, version, snapVersion)
+	default:
+		err = fmt.Errorf("%s: snapshot version %d is not supported", path, version)
+	}
+	return
+}
+
+// restoreSnap() restores the machine state from a snapshot file.
+func restoreSnap(path string) error {
+	ss, err := loadSnap(path)
+	if err != nil {
+		return err
+	}
+	return putSnap(ss)
+}
@@ -0,0 +1,143 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The symbol table holds every symbol known to the emulator: labels
+// from LST, dbg and o65 files as well as symbols imported from symbol
+// tables. Two symbol table formats are understood and may be mixed:
+//
+// VICE label files (.lbl or .vs, as written by the VICE monitor or by
+// ld65 -Ln), where each line defines a label with an optional address
+// space prefix:
+//
+//	al C:0200 .start
+//
+// Symbol tables as listed in the as65 LST file by its -t option (or
+// saved from it to a file). This sample is from as65 1.42:
+//
+//	-------------------------------- Symbol Table --------------------------------
+//
+//	              Symbol   Value        Decimal
+//
+//	               absAN : $023c            572
+//	              chkadi : $3d54          15700   *
+//	            cmp_flag : <macro>
+//	                 big : $12345678  305419896
+//	                  zp : $0010             16
+//
+//	318 labels used
+//
+// Every label is listed in the same way, whether it is an address or an
+// equ constant and including zero page. Values are shown with 4 hex
+// digits where possible and otherwise 8. Redefinable labels (defined
+// with set or =) are marked with * and macros have no value.
+//
+// Symbols are used for instruction operands, memory dumps and command
+// arguments. Where several symbols have the same value, the first one
+// defined is used.
+
+// symRow matches a row of an as65 symbol table (name, hex value and
+// decimal value, which is followed by * for redefinable labels).
+var symRow = regexp.MustCompile(`^\s*([A-Za-z_.@?][\w.@?]*) : \$([0-9A-Fa-f]{4}|[0-9A-Fa-f]{8})\s+-?\d+(?:\s+\*)?\s*$`)
+
+// addSym() adds a symbol to the symbol table.
+func addSym(name string, val uint16) {
+	if len(name) == 0 {
+		return
+	}
+	if _, ok := syms[name]; ok {
+		return
+	}
+	syms[name] = val
+	if _, ok := symNames[val]; !ok {
+		symNames[val] = name
+	}
+}
+
+// symName() returns the name of the symbol with the given value
+// (or an empty string if there is none).
+func symName(val uint16) string {
+	return symNames[val]
+}
+
+// loadSyms() loads a VICE label file or symbol table.
+// It returns false if the file cannot be opened.
+func loadSyms(path string) (found bool) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintln(msgOut, "Found symbol file:", path)
+	scanner := bufio.NewScanner(file)
+	lineCount := 0
+	symCount := 0
+	for scanner.Scan() {
+		lineCount++
+		symCount += parseSyms(scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(msgOut, lineCount, "lines processed")
+	fmt.Fprintln(msgOut, symCount, "symbols found\n")
+	return true
+}
+
+// parseSyms() adds the symbols defined on a line of a VICE label
+// file or symbol table. It returns the number of symbols found.
+func parseSyms(line string) (n int) {
+	fields := strings.Fields(line)
+	if len(fields) == 3 && fields[0] == "al" {
+		hexAddr := fields[1]
+		if i := strings.Index(hexAddr, ":"); i >= 0 {
+			hexAddr = hexAddr[i+1:]
+		}
+		addr, err := strconv.ParseUint(hexAddr, 16, 32)
+		if err != nil || addr > uint64(memMax) {
+			return
+		}
+		addSym(strings.TrimPrefix(fields[2], "."), uint16(addr))
+		return 1
+	}
+	if m := symRow.FindStringSubmatch(line); m != nil {
+		val, _ := strconv.ParseUint(m[2], 16, 32)
+		if val <= uint64(memMax) {
+			addSym(m[1], uint16(val))
+			n++
+		}
+	}
+	return
+}
+
+// fmtSyms() formats the symbols for a range of addresses.
+func fmtSyms(start uint16, end uint16) (s string) {
+	for addr := uint32(start); addr <= uint32(end); addr++ {
+		if name := symName(uint16(addr)); len(name) > 0 {
+			s += " " + fmtWord(uint16(addr)) + "=" + name
+		}
+	}
+	return
+}
+
+// String() formats a list of file paths for the flag package.
+func (paths *pathList) String() string {
+	return fmt.Sprint(*paths)
+}
+
+// Set() adds a file path to a list for the flag package.
+func (paths *pathList) Set(val string) error {
+	*paths = append(*paths, val)
+	return nil
+}
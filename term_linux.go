@@ -0,0 +1,100 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// termState is the saved state of a terminal.
+type termState syscall.Termios
+
+// ioctl() performs an ioctl system call on a file descriptor.
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw() puts a terminal into raw mode, with no line editing, echo,
+// signals or output processing. It returns the previous state.
+func makeRaw(fd uintptr) (*termState, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	state := termState(old)
+	return &state, nil
+}
+
+// makeCbreak() turns off line editing and echo on a terminal, leaving
+// signals and output processing on. It returns the previous state.
+func makeCbreak(fd uintptr) (*termState, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	cbreak := old
+	cbreak.Lflag &^= syscall.ECHO | syscall.ICANON
+	cbreak.Cc[syscall.VMIN] = 1
+	cbreak.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&cbreak)); err != nil {
+		return nil, err
+	}
+	state := termState(old)
+	return &state, nil
+}
+
+// restoreTerm() restores the state of a terminal.
+func restoreTerm(fd uintptr, state *termState) error {
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(state))
+}
+
+// openPty() opens a pseudo-terminal and returns its master side along
+// with the path of the slave side for terminal programs to open. The
+// slave side is held open in raw mode so that the master can be used
+// before and between terminal program sessions.
+func openPty() (master *os.File, path string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	var unlock int32
+	var n uint32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	path = fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err == nil {
+		_, err = makeRaw(slave.Fd())
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	ptySlaves = append(ptySlaves, slave)
+	return
+}
@@ -0,0 +1,35 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// termState is the saved state of a terminal.
+type termState struct{}
+
+var errNoTerm = errors.New("terminal control not supported on this system")
+
+// makeRaw() puts a terminal into raw mode (not supported).
+func makeRaw(fd uintptr) (*termState, error) {
+	return nil, errNoTerm
+}
+
+// makeCbreak() turns off line editing and echo (not supported).
+func makeCbreak(fd uintptr) (*termState, error) {
+	return nil, errNoTerm
+}
+
+// restoreTerm() restores the state of a terminal (not supported).
+func restoreTerm(fd uintptr, state *termState) error {
+	return errNoTerm
+}
+
+// openPty() opens a pseudo-terminal (not supported).
+func openPty() (master *os.File, path string, err error) {
+	return nil, "", errNoTerm
+}
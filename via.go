@@ -0,0 +1,576 @@
+// Copyright 2012 RVJ Callanan. All rights reserved.
+
+package main
+
+// The 6522 VIA (Versatile Interface Adapter) has two 8-bit ports with
+// data direction registers, two 16-bit timers, a shift register and
+// four handshake lines (CA1, CA2, CB1 and CB2), with an interrupt flag
+// register (IFR) and interrupt enable register (IER) driving IRQ.
+//
+// Timers count down once per cycle against the cycle clock. T1 counts
+// N, N-1 ... 0, FFFF and sets its interrupt flag on reaching FFFF. In
+// free-run mode it then reloads from the latches, giving a period of
+// N+2 cycles, otherwise it continues counting down without further
+// interrupts until written again. T1 may drive PB7: low when started
+// and high at timeout in one-shot mode or inverted at each timeout in
+// free-run mode. T2 is one-shot only, either timed or counting falling
+// edges on PB6.
+//
+// The shift register shifts one bit every 2 cycles (phase 2 modes) or
+// every 2(N+2) cycles where N is the T2 low latch (T2 modes), or on the
+// edges of CB1 given by the host (external modes). CB1 is pulsed for
+// each bit shifted under internal control and CB2 carries the data.
+//
+// As with all devices, register accesses take effect at the cycle
+// clock value at the start of the instruction. The ports (pa and pb)
+// and handshake lines (ca1, ca2, cb1 and cb2) are available to the host
+// as device pins. Input pins are pulled high until driven by the host.
+
+// VIA register offsets
+const (
+	viaOrb  = 0x0 // Output/input register B
+	viaOra  = 0x1 // Output/input register A
+	viaDdrb = 0x2 // Data direction register B
+	viaDdra = 0x3 // Data direction register A
+	viaT1cl = 0x4 // T1 counter low (latch low when written)
+	viaT1ch = 0x5 // T1 counter high
+	viaT1ll = 0x6 // T1 latch low
+	viaT1lh = 0x7 // T1 latch high
+	viaT2cl = 0x8 // T2 counter low (latch low when written)
+	viaT2ch = 0x9 // T2 counter high
+	viaSr   = 0xA // Shift register
+	viaAcr  = 0xB // Auxiliary control register
+	viaPcr  = 0xC // Peripheral control register
+	viaIfr  = 0xD // Interrupt flag register
+	viaIer  = 0xE // Interrupt enable register
+	viaOran = 0xF // Output/input register A without handshake
+)
+
+// VIA interrupt flags
+const (
+	viaIrqCa2 = 0x01
+	viaIrqCa1 = 0x02
+	viaIrqSr  = 0x04
+	viaIrqCb2 = 0x08
+	viaIrqCb1 = 0x10
+	viaIrqT2  = 0x20
+	viaIrqT1  = 0x40
+	viaIrqAny = 0x80
+)
+
+// VIA auxiliary control register fields
+const (
+	viaAcrLatchA = 0x01 // Latch port A inputs on CA1 edge
+	viaAcrLatchB = 0x02 // Latch port B inputs on CB1 edge
+	viaAcrSr     = 0x1C // Shift register mode
+	viaAcrSrOut  = 0x10 // Shift register shifts out
+	viaAcrT2Pb6  = 0x20 // T2 counts PB6 pulses
+	viaAcrT1Free = 0x40 // T1 free-run mode
+	viaAcrT1Pb7  = 0x80 // T1 drives PB7
+)
+
+// VIA shift register modes (ACR bits 2-4)
+const (
+	viaSrOff     = 0 << 2
+	viaSrInT2    = 1 << 2
+	viaSrInPhi2  = 2 << 2
+	viaSrInExt   = 3 << 2
+	viaSrOutFree = 4 << 2
+	viaSrOutT2   = 5 << 2
+	viaSrOutPhi2 = 6 << 2
+	viaSrOutExt  = 7 << 2
+)
+
+// VIA CA2 and CB2 control modes (PCR bits 1-3 and 5-7)
+const (
+	viaC2InNeg     = 0 // Input, negative active edge
+	viaC2IndNeg    = 1 // Independent interrupt input, negative edge
+	viaC2InPos     = 2 // Input, positive active edge
+	viaC2IndPos    = 3 // Independent interrupt input, positive edge
+	viaC2Handshake = 4 // Handshake output
+	viaC2Pulse     = 5 // Pulse output
+	viaC2Low       = 6 // Manual output low
+	viaC2High      = 7 // Manual output high
+)
+
+// viaRegs is the state of a VIA.
+// Fields must be exported for gob encoding.
+type viaRegs struct {
+	Ora, Orb   uint8 // Output registers
+	Ddra, Ddrb uint8 // Data direction registers (1 = output)
+	Ira, Irb   uint8 // Input latches
+	PaIn, PbIn uint8 // Port levels driven by the host
+	PaOut      uint8 // Port A levels last reported to the host
+	PbOut      uint8 // Port B levels last reported to the host
+
+	T1     uint16 // T1 counter
+	T1L    uint16 // T1 latches
+	T1Arm  bool   // T1 one-shot interrupt armed
+	T1Load bool   // T1 reload from latches due
+	Pb7    bool   // T1 PB7 output level
+	T2     uint16 // T2 counter
+	T2L    uint8  // T2 low latch
+	T2Arm  bool   // T2 interrupt armed
+
+	Sr     uint8 // Shift register
+	SrBits int   // Bits shifted since started
+	SrRun  bool  // Shift register running
+	SrCk   int   // Cycles to next shift
+
+	Acr, Pcr uint8 // Control registers
+	Ifr, Ier uint8 // Interrupt flag and enable registers
+
+	Ca1, Ca2, Cb1, Cb2 bool // Handshake line levels
+	Ca2Pulse           bool // CA2 pulse output ends on next cycle
+	Cb2Pulse           bool // CB2 pulse output ends on next cycle
+}
+
+// via is a 6522 VIA device.
+type via struct {
+	id string
+	viaRegs
+}
+
+// newVia() creates a VIA from a device specification.
+func newVia(spec devSpec) (device, error) {
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+	v := &via{id: spec.name}
+	v.PaIn, v.PbIn, v.PaOut, v.PbOut = 0xFF, 0xFF, 0xFF, 0xFF
+	v.Ca1, v.Ca2, v.Cb1, v.Cb2 = true, true, true, true
+	v.T1, v.T1L, v.T2, v.T2L = 0xFFFF, 0xFFFF, 0xFFFF, 0xFF
+	return v, nil
+}
+
+func (v *via) name() string { return v.id }
+
+// reset() clears all registers apart from the timers and shift register.
+func (v *via) reset() {
+	v.Ora, v.Orb, v.Ddra, v.Ddrb = 0, 0, 0, 0
+	v.Acr, v.Pcr, v.Ifr, v.Ier = 0, 0, 0, 0
+	v.T1Arm, v.T2Arm, v.SrRun = false, false, false
+	v.Ca2Pulse, v.Cb2Pulse = false, false
+	v.Ca2, v.Cb2 = v.c2In(v.Ca2, 1), v.c2In(v.Cb2, 5)
+	v.update()
+}
+
+func (v *via) read(off uint16) (data uint8) {
+	data = v.peek(off)
+	switch off {
+	case viaOrb:
+		v.clear(viaIrqCb1 | v.c2Clear(5, viaIrqCb2))
+	case viaOra:
+		v.clear(viaIrqCa1 | v.c2Clear(1, viaIrqCa2))
+		v.handshakeA()
+	case viaT1cl:
+		v.clear(viaIrqT1)
+	case viaT2cl:
+		v.clear(viaIrqT2)
+	case viaSr:
+		v.startSr()
+	}
+	v.update()
+	return
+}
+
+func (v *via) peek(off uint16) (data uint8) {
+	switch off {
+	case viaOrb:
+		in := v.portB()
+		if v.Acr&viaAcrLatchB != 0 {
+			in = v.Irb
+		}
+		data = v.Orb&v.Ddrb | in&^v.Ddrb
+		if v.Acr&viaAcrT1Pb7 != 0 {
+			data = data&0x7F | v.portB()&0x80
+		}
+	case viaOra, viaOran:
+		data = v.portA()
+		if v.Acr&viaAcrLatchA != 0 {
+			data = v.Ira
+		}
+	case viaDdrb:
+		data = v.Ddrb
+	case viaDdra:
+		data = v.Ddra
+	case viaT1cl:
+		data = uint8(v.T1)
+	case viaT1ch:
+		data = uint8(v.T1 >> 8)
+	case viaT1ll:
+		data = uint8(v.T1L)
+	case viaT1lh:
+		data = uint8(v.T1L >> 8)
+	case viaT2cl:
+		data = uint8(v.T2)
+	case viaT2ch:
+		data = uint8(v.T2 >> 8)
+	case viaSr:
+		data = v.Sr
+	case viaAcr:
+		data = v.Acr
+	case viaPcr:
+		data = v.Pcr
+	case viaIfr:
+		data = v.Ifr
+		if v.Ifr&v.Ier != 0 {
+			data |= viaIrqAny
+		}
+	case viaIer:
+		data = v.Ier | viaIrqAny
+	}
+	return
+}
+
+func (v *via) write(off uint16, data uint8) {
+	switch off {
+	case viaOrb:
+		v.Orb = data
+		v.clear(viaIrqCb1 | v.c2Clear(5, viaIrqCb2))
+		v.handshakeB()
+	case viaOra:
+		v.Ora = data
+		v.clear(viaIrqCa1 | v.c2Clear(1, viaIrqCa2))
+		v.handshakeA()
+	case viaOran:
+		v.Ora = data
+	case viaDdrb:
+		v.Ddrb = data
+	case viaDdra:
+		v.Ddra = data
+	case viaT1cl, viaT1ll:
+		v.T1L = v.T1L&0xFF00 | uint16(data)
+	case viaT1ch:
+		v.T1L = v.T1L&0x00FF | uint16(data)<<8
+		v.T1, v.T1Arm, v.T1Load = v.T1L, true, false
+		v.Pb7 = false
+		v.clear(viaIrqT1)
+	case viaT1lh:
+		v.T1L = v.T1L&0x00FF | uint16(data)<<8
+		v.clear(viaIrqT1)
+	case viaT2cl:
+		v.T2L = data
+	case viaT2ch:
+		v.T2, v.T2Arm = uint16(data)<<8|uint16(v.T2L), true
+		v.clear(viaIrqT2)
+	case viaSr:
+		v.Sr = data
+		v.startSr()
+	case viaAcr:
+		v.Acr = data
+		if data&viaAcrSr == viaSrOff {
+			v.SrRun = false
+		}
+	case viaPcr:
+		v.Pcr = data
+		v.Ca2, v.Cb2 = v.c2In(v.Ca2, 1), v.c2In(v.Cb2, 5)
+		v.c2Out("ca2", &v.Ca2, 1)
+		v.c2Out("cb2", &v.Cb2, 5)
+	case viaIfr:
+		v.clear(data & 0x7F)
+	case viaIer:
+		if data&viaIrqAny != 0 {
+			v.Ier |= data & 0x7F
+		} else {
+			v.Ier &^= data
+		}
+	}
+	v.update()
+}
+
+// tick() advances the timers and shift register cycle by cycle.
+func (v *via) tick(cycles uint64) {
+	for ; cycles > 0; cycles-- {
+		v.step()
+	}
+	v.update()
+}
+
+// step() advances the VIA by one cycle.
+func (v *via) step() {
+	if v.Ca2Pulse {
+		v.Ca2Pulse = false
+		v.setLine("ca2", &v.Ca2, true)
+	}
+	if v.Cb2Pulse {
+		v.Cb2Pulse = false
+		v.setLine("cb2", &v.Cb2, true)
+	}
+
+	// T1
+	if v.T1Load {
+		v.T1, v.T1Load = v.T1L, false
+	} else if v.T1--; v.T1 == 0xFFFF {
+		switch {
+		case v.Acr&viaAcrT1Free != 0:
+			v.T1Load = true
+			v.Pb7 = !v.Pb7
+			v.Ifr |= viaIrqT1
+		case v.T1Arm:
+			v.T1Arm = false
+			v.Pb7 = true
+			v.Ifr |= viaIrqT1
+		}
+	}
+
+	// T2 (timed mode)
+	if v.Acr&viaAcrT2Pb6 == 0 {
+		if v.T2--; v.T2 == 0xFFFF && v.T2Arm {
+			v.T2Arm = false
+			v.Ifr |= viaIrqT2
+		}
+	}
+
+	// Shift register (internal clock)
+	switch v.Acr & viaAcrSr {
+	case viaSrInT2, viaSrInPhi2, viaSrOutFree, viaSrOutT2, viaSrOutPhi2:
+		if v.SrRun {
+			if v.SrCk--; v.SrCk <= 0 {
+				v.SrCk = v.srPeriod()
+				v.shift()
+				pinOut(v, "cb1", 0)
+				pinOut(v, "cb1", 1)
+			}
+		}
+	}
+}
+
+// srPeriod() returns the number of cycles per bit shifted
+// under internal control.
+func (v *via) srPeriod() int {
+	switch v.Acr & viaAcrSr {
+	case viaSrInPhi2, viaSrOutPhi2:
+		return 2
+	}
+	return 2 * (int(v.T2L) + 2)
+}
+
+// startSr() restarts the shift register after it is read or written.
+func (v *via) startSr() {
+	v.clear(viaIrqSr)
+	v.SrRun = v.Acr&viaAcrSr != viaSrOff
+	v.SrBits = 0
+	v.SrCk = v.srPeriod()
+}
+
+// shift() shifts one bit into or out of the shift register. Bits are
+// shifted out from bit 7 onto CB2 and rotated back into bit 0. Bits are
+// shifted in from CB2 into bit 0.
+func (v *via) shift() {
+	if v.Acr&viaAcrSrOut != 0 {
+		v.setLine("cb2", &v.Cb2, v.Sr&0x80 != 0)
+		v.Sr = v.Sr<<1 | v.Sr>>7
+	} else {
+		v.Sr <<= 1
+		if v.Cb2 {
+			v.Sr |= 1
+		}
+	}
+	if v.SrBits++; v.SrBits == 8 {
+		v.SrBits = 0
+		if v.Acr&viaAcrSr != viaSrOutFree {
+			v.SrRun = false
+			v.Ifr |= viaIrqSr
+		}
+	}
+}
+
+// portA() returns the levels of the port A pins.
+func (v *via) portA() uint8 {
+	return v.Ora&v.Ddra | v.PaIn&^v.Ddra
+}
+
+// portB() returns the levels of the port B pins.
+func (v *via) portB() (data uint8) {
+	data = v.Orb&v.Ddrb | v.PbIn&^v.Ddrb
+	if v.Acr&viaAcrT1Pb7 != 0 {
+		data &= 0x7F
+		if v.Pb7 {
+			data |= 0x80
+		}
+	}
+	return
+}
+
+// c2Mode() returns the control mode of CA2 (shift 1) or CB2 (shift 5).
+func (v *via) c2Mode(shift uint) uint8 {
+	return v.Pcr >> shift & 7
+}
+
+// c2Clear() returns the CA2 or CB2 interrupt flag to be cleared by
+// accessing the port register (none for independent interrupts).
+func (v *via) c2Clear(shift uint, flag uint8) uint8 {
+	switch v.c2Mode(shift) {
+	case viaC2IndNeg, viaC2IndPos:
+		return 0
+	}
+	return flag
+}
+
+// c2In() returns the level of CA2 or CB2 when it becomes an input.
+func (v *via) c2In(level bool, shift uint) bool {
+	if v.c2Mode(shift) < viaC2Handshake {
+		return true
+	}
+	return level
+}
+
+// c2Out() drives CA2 or CB2 for the manual output modes.
+func (v *via) c2Out(pin string, line *bool, shift uint) {
+	switch v.c2Mode(shift) {
+	case viaC2Low:
+		v.setLine(pin, line, false)
+	case viaC2High:
+		v.setLine(pin, line, true)
+	}
+}
+
+// handshakeA() drives CA2 low on a port A access in the handshake
+// and pulse output modes.
+func (v *via) handshakeA() {
+	switch v.c2Mode(1) {
+	case viaC2Pulse:
+		v.Ca2Pulse = true
+		fallthrough
+	case viaC2Handshake:
+		v.setLine("ca2", &v.Ca2, false)
+	}
+}
+
+// handshakeB() drives CB2 low on a port B write in the handshake
+// and pulse output modes.
+func (v *via) handshakeB() {
+	switch v.c2Mode(5) {
+	case viaC2Pulse:
+		v.Cb2Pulse = true
+		fallthrough
+	case viaC2Handshake:
+		v.setLine("cb2", &v.Cb2, false)
+	}
+}
+
+// setLine() drives a handshake line, reporting changes to the host.
+func (v *via) setLine(pin string, line *bool, level bool) {
+	if *line != level {
+		*line = level
+		pinOut(v, pin, pinLevel(level))
+	}
+}
+
+// clear() clears interrupt flags.
+func (v *via) clear(flags uint8) {
+	v.Ifr &^= flags
+}
+
+// update() drives IRQ from the interrupt flags and reports any change
+// of the port outputs to the host.
+func (v *via) update() {
+	setIrq(v, v.Ifr&v.Ier&0x7F != 0)
+	if a := v.portA(); a != v.PaOut {
+		v.PaOut = a
+		pinOut(v, "pa", a)
+	}
+	if b := v.portB(); b != v.PbOut {
+		v.PbOut = b
+		pinOut(v, "pb", b)
+	}
+}
+
+func (v *via) pins() []string {
+	return []string{"pa", "pb", "ca1", "ca2", "cb1", "cb2"}
+}
+
+func (v *via) pin(name string) uint8 {
+	switch name {
+	case "pa":
+		return v.portA()
+	case "pb":
+		return v.portB()
+	case "ca1":
+		return pinLevel(v.Ca1)
+	case "ca2":
+		return pinLevel(v.Ca2)
+	case "cb1":
+		return pinLevel(v.Cb1)
+	case "cb2":
+		return pinLevel(v.Cb2)
+	}
+	return 0
+}
+
+// setPin() drives the VIA inputs. Active edges of the handshake lines
+// set interrupt flags, latch port inputs and complete handshakes.
+// Falling edges of PB6 are counted by T2 in pulse counting mode.
+func (v *via) setPin(name string, level uint8) {
+	high := level != 0
+	switch name {
+	case "pa":
+		v.PaIn = level
+	case "pb":
+		fall := v.PbIn&^level&^v.Ddrb&0x40 != 0
+		v.PbIn = level
+		if fall && v.Acr&viaAcrT2Pb6 != 0 {
+			if v.T2--; v.T2 == 0 && v.T2Arm {
+				v.T2Arm = false
+				v.Ifr |= viaIrqT2
+			}
+		}
+	case "ca1":
+		if high != v.Ca1 {
+			v.Ca1 = high
+			if high == (v.Pcr&0x01 != 0) {
+				v.Ifr |= viaIrqCa1
+				v.Ira = v.portA()
+				if v.c2Mode(1) == viaC2Handshake {
+					v.setLine("ca2", &v.Ca2, true)
+				}
+			}
+		}
+	case "ca2":
+		if mode := v.c2Mode(1); mode < viaC2Handshake && high != v.Ca2 {
+			v.Ca2 = high
+			if high == (mode&viaC2InPos != 0) {
+				v.Ifr |= viaIrqCa2
+			}
+		}
+	case "cb1":
+		if high != v.Cb1 {
+			v.Cb1 = high
+			if high == (v.Pcr&0x10 != 0) {
+				v.Ifr |= viaIrqCb1
+				v.Irb = v.portB()
+				if v.c2Mode(5) == viaC2Handshake {
+					v.setLine("cb2", &v.Cb2, true)
+				}
+			}
+			// External shift clock: shift in on rising edges
+			// and out on falling edges
+			mode := v.Acr & viaAcrSr
+			if v.SrRun && (mode == viaSrInExt && high || mode == viaSrOutExt && !high) {
+				v.shift()
+			}
+		}
+	case "cb2":
+		if mode := v.c2Mode(5); mode < viaC2Handshake && high != v.Cb2 {
+			v.Cb2 = high
+			if high == (mode&viaC2InPos != 0) {
+				v.Ifr |= viaIrqCb2
+			}
+		}
+	}
+	v.update()
+}
+
+func (v *via) state() []byte {
+	return encodeState(&v.viaRegs)
+}
+
+func (v *via) setState(state []byte) error {
+	v.viaRegs = viaRegs{}
+	if err := decodeState(state, &v.viaRegs); err != nil {
+		return err
+	}
+	v.update()
+	return nil
+}